@@ -0,0 +1,173 @@
+package tcprouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AccessConfig restricts the source addresses allowed to reach a service
+type AccessConfig struct {
+	// Allow is the list of CIDRs or IP addresses allowed. An empty list allows every source
+	Allow []string `toml:"allow"`
+	// Deny is the list of CIDRs or IP addresses denied, it has precedence over Allow
+	Deny []string `toml:"deny"`
+}
+
+func (c AccessConfig) isSet() bool {
+	return len(c.Allow) != 0 || len(c.Deny) != 0
+}
+
+func (c AccessConfig) validate() error {
+	if _, err := parseCIDRs(c.Allow); err != nil {
+		return fmt.Errorf("invalid allow list: %w", err)
+	}
+	if _, err := parseCIDRs(c.Deny); err != nil {
+		return fmt.Errorf("invalid deny list: %w", err)
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of CIDRs, plain IP addresses are considered as a single address network
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, cidr := range list {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// accessLists are the parsed lists of an AccessConfig
+type accessLists struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// maxCachedAccessLists bounds the number of parsed access configurations kept in memory,
+// the cache is emptied once it is reached
+const maxCachedAccessLists = 1024
+
+// accessCache keeps the parsed lists of the access configurations, so connections only
+// have to match their address
+type accessCache struct {
+	mu    sync.Mutex
+	lists map[string]*accessLists
+}
+
+// get returns the parsed lists of cfg
+func (c *accessCache) get(cfg AccessConfig) (*accessLists, error) {
+	key := strings.Join(cfg.Allow, ",") + "|" + strings.Join(cfg.Deny, ",")
+	c.mu.Lock()
+	lists, ok := c.lists[key]
+	c.mu.Unlock()
+	if ok {
+		return lists, nil
+	}
+
+	allow, err := parseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	lists = &accessLists{allow: allow, deny: deny}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lists == nil || len(c.lists) >= maxCachedAccessLists {
+		c.lists = make(map[string]*accessLists)
+	}
+	c.lists[key] = lists
+	return lists, nil
+}
+
+// errAccessDenied is returned when the source of a connection is not allowed to reach a service
+var errAccessDenied = errors.New("access denied")
+
+// sourceIP returns the IP address of addr, nil if it doesn't have one, e.g. for unix sockets
+func sourceIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// checkAccess returns an error wrapping errAccessDenied with the reason of the denial
+// if src can't reach service. The access lists of the server are used for the services
+// that don't define their own
+func (s *Server) checkAccess(service Service, src net.Addr) error {
+	cfg := service.Access
+	if !cfg.isSet() {
+		cfg = s.ServerOptions.Access
+	}
+	if !cfg.isSet() {
+		return nil
+	}
+
+	ip := sourceIP(src)
+	if ip == nil {
+		return fmt.Errorf("%w: unknown source address %v", errAccessDenied, src)
+	}
+
+	lists, err := s.access.get(cfg)
+	if err != nil {
+		return err
+	}
+	for _, ipNet := range lists.deny {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("%w: source %s matches deny %s", errAccessDenied, ip, ipNet)
+		}
+	}
+
+	if len(lists.allow) == 0 {
+		return nil
+	}
+	for _, ipNet := range lists.allow {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: source %s is not in the allow list", errAccessDenied, ip)
+}
+
+func logAccessDenied(err error, serverName string, src net.Addr) {
+	log.Warn().
+		Err(err).
+		Str("server name", serverName).
+		Str("remote addr", src.String()).
+		Msg("connection refused")
+}
+
+// tlsAccessDeniedAlert is a fatal TLS alert record with the access_denied description
+var tlsAccessDeniedAlert = []byte{
+	0x15,       // content type: alert
+	0x03, 0x03, // version: TLS 1.2, also used by TLS 1.3 records
+	0x00, 0x02, // length
+	0x02, // level: fatal
+	0x31, // description: access_denied (49)
+}
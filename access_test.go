@@ -0,0 +1,129 @@
+package tcprouter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAccess(t *testing.T) {
+	s := NewServer(ServerOptions{Access: AccessConfig{Deny: []string{"192.0.2.0/24"}}}, nil, nil)
+	src := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	// server lists apply to the services without their own
+	assert.Equal(t, errors.Is(s.checkAccess(Service{}, src("192.0.2.10")), errAccessDenied), true)
+	assert.Equal(t, s.checkAccess(Service{}, src("198.51.100.1")), nil)
+
+	service := Service{Access: AccessConfig{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32", "203.0.113.7"},
+		Deny:  []string{"10.1.0.0/16"},
+	}}
+	assert.Equal(t, s.checkAccess(service, src("10.2.3.4")), nil)
+	assert.Equal(t, s.checkAccess(service, src("2001:db8::1")), nil)
+	assert.Equal(t, s.checkAccess(service, src("203.0.113.7")), nil)
+	assert.Equal(t, s.checkAccess(service, &net.UDPAddr{IP: net.ParseIP("10.2.3.4")}), nil)
+
+	err := s.checkAccess(service, src("10.1.2.3"))
+	assert.Equal(t, errors.Is(err, errAccessDenied), true)
+	assert.Equal(t, strings.Contains(err.Error(), "deny 10.1.0.0/16"), true)
+	err = s.checkAccess(service, src("203.0.113.8"))
+	assert.Equal(t, strings.Contains(err.Error(), "not in the allow list"), true)
+	// the service lists replace the server ones
+	assert.Equal(t, s.checkAccess(Service{Access: AccessConfig{Allow: []string{"192.0.2.0/24"}}}, src("192.0.2.10")), nil)
+
+	assert.Equal(t, AccessConfig{Allow: []string{"10.0.0.0/33"}}.validate() != nil, true)
+	assert.Equal(t, AccessConfig{Deny: []string{"not an ip"}}.validate() != nil, true)
+}
+
+func TestAccessCache(t *testing.T) {
+	c := accessCache{}
+	cfg := AccessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}
+
+	// the lists are parsed once per configuration
+	lists, err := c.get(cfg)
+	require.NoError(t, err)
+	again, err := c.get(AccessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}})
+	require.NoError(t, err)
+	assert.Equal(t, again == lists, true)
+	other, err := c.get(AccessConfig{Allow: []string{"10.0.0.0/8", "10.1.0.0/16"}})
+	require.NoError(t, err)
+	assert.Equal(t, other == lists, false)
+
+	_, err = c.get(AccessConfig{Deny: []string{"not an ip"}})
+	require.Error(t, err)
+
+	for i := 0; i < maxCachedAccessLists; i++ {
+		_, err := c.get(AccessConfig{Allow: []string{fmt.Sprintf("10.0.%d.%d", i/256, i%256)}})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, len(c.lists) <= maxCachedAccessLists, true)
+}
+
+func TestAccessDeniedTLSAlert(t *testing.T) {
+	backend := lineEcho(t)
+	defer backend.Close()
+
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"example.com": {
+			Addr:    "127.0.0.1",
+			TLSPort: backend.Addr().(*net.TCPAddr).Port,
+			Access:  AccessConfig{Deny: []string{"127.0.0.0/8"}},
+		},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn.(*net.TCPConn))
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	err = tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+	require.Error(t, err)
+	assert.Equal(t, strings.Contains(err.Error(), "access denied"), true)
+}
+
+func TestAccessDeniedHTTP(t *testing.T) {
+	for _, mode := range []string{HTTPModeConnection, HTTPModeRequest} {
+		a, aPort := httpBackend(t, "a")
+		defer a.Close()
+
+		s := NewServer(ServerOptions{HTTP: HTTPConfig{Mode: mode}}, nil, map[string]Service{
+			"a.com": {Addr: "127.0.0.1", HTTPPort: aPort, Access: AccessConfig{Allow: []string{"192.0.2.0/24"}}},
+		})
+		l := serveHTTP(t, s)
+		defer l.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden, mode)
+	}
+}
@@ -0,0 +1,233 @@
+package tcprouter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	acmeChallengePrefix    = "/.well-known/acme-challenge/"
+	defaultACMERenewBefore = 30
+	acmeChallengeTimeout   = 10 * time.Second
+	// challenge responses are tokens, anything bigger is an error
+	maxChallengeResponseSize = 64 << 10
+)
+
+// ACMEConfig configures the ACME client used to obtain the certificates of the services
+// that terminate TLS with acme enabled
+type ACMEConfig struct {
+	// Email is the contact address of the ACME account
+	Email string `toml:"email"`
+	// Directory is the URL of the ACME directory, default to Let's Encrypt production
+	Directory string `toml:"directory"`
+	// CACert is a PEM file with the certificates trusted to reach the ACME directory,
+	// e.g. the root of a local pebble test server. System roots are used if not set
+	CACert string `toml:"cacert"`
+	// RenewBefore is the number of days before expiry at which certificates are renewed
+	RenewBefore uint `toml:"renewbefore"`
+}
+
+// acmeCache stores the ACME account, certificates and challenge tokens in the db backend
+// so they are shared by all the router instances using the same store
+type acmeCache struct {
+	kv store.Store
+}
+
+func acmeKey(name string) string {
+	return fmt.Sprintf("tcprouter/acme/%s", name)
+}
+
+// Get implements autocert.Cache
+func (c acmeCache) Get(ctx context.Context, name string) ([]byte, error) {
+	pair, err := c.kv.Get(acmeKey(name), nil)
+	if err == store.ErrKeyNotFound {
+		return nil, autocert.ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+	return pair.Value, nil
+}
+
+// Put implements autocert.Cache
+func (c acmeCache) Put(ctx context.Context, name string, data []byte) error {
+	return c.kv.Put(acmeKey(name), data, nil)
+}
+
+// Delete implements autocert.Cache
+func (c acmeCache) Delete(ctx context.Context, name string) error {
+	err := c.kv.Delete(acmeKey(name))
+	if err == store.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// acmeManager obtains and renews certificates and answers the ACME challenges
+type acmeManager struct {
+	manager *autocert.Manager
+	http01  http.Handler
+}
+
+func (s *Server) newACMEManager(cfg ACMEConfig) (*acmeManager, error) {
+	client := &acme.Client{DirectoryURL: cfg.Directory}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read acme cacert: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.CACert)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	renewBefore := cfg.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = defaultACMERenewBefore
+	}
+
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Email:       cfg.Email,
+		Client:      client,
+		HostPolicy:  s.acmeHostPolicy,
+		RenewBefore: time.Duration(renewBefore) * 24 * time.Hour,
+	}
+	if s.DbStore != nil {
+		manager.Cache = acmeCache{kv: s.DbStore}
+	}
+
+	return &acmeManager{
+		manager: manager,
+		http01: manager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		})),
+	}, nil
+}
+
+// acmeHostPolicy only allows issuing certificates for the services registered under host
+// that enabled acme. The services matched through a wildcard name or CATCH_ALL are refused,
+// otherwise clients could make the router request a certificate for any name they send
+func (s *Server) acmeHostPolicy(ctx context.Context, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHost(host)
+	if strings.HasPrefix(host, "*.") {
+		return fmt.Errorf("acme: wildcard certificates are not supported")
+	}
+	if host == "" || host == catchAllService {
+		return fmt.Errorf("acme: no service with acme enabled for %s", host)
+	}
+	service, ok := s.services.Resolve(host)
+	if !ok || !service.ACME {
+		return fmt.Errorf("acme: no service with acme enabled for %s", host)
+	}
+	return nil
+}
+
+// isACMEChallenge returns true if req is an HTTP-01 challenge request
+// for a service that obtains its certificate with acme
+func (s *Server) isACMEChallenge(req *http.Request) bool {
+	if s.acme == nil || !strings.HasPrefix(req.URL.Path, acmeChallengePrefix) {
+		return false
+	}
+	return s.acmeHostPolicy(context.Background(), req.Host) == nil
+}
+
+// serveACMEChallenge answers the HTTP-01 challenge request req and closes conn
+func (s *Server) serveACMEChallenge(conn WriteCloser, req *http.Request) error {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(acmeChallengeTimeout))
+
+	w := &challengeResponse{header: make(http.Header)}
+	s.acme.http01.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	log.Info().
+		Str("server name", req.Host).
+		Str("path", req.URL.Path).
+		Int("status", w.status).
+		Msg("acme http-01 challenge")
+
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Close:         true,
+	}
+	return resp.Write(conn)
+}
+
+// challengeResponse records the response to an HTTP-01 challenge
+type challengeResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *challengeResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *challengeResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *challengeResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(p) > maxChallengeResponseSize {
+		return 0, errors.New("acme challenge response too large")
+	}
+	return w.body.Write(p)
+}
+
+// errACMEChallenge is returned when a TLS connection was a TLS-ALPN-01 challenge
+// answered by the router, there is nothing to forward
+var errACMEChallenge = errors.New("acme tls-alpn-01 challenge answered")
+
+// acmeCertificate returns the certificate obtained with acme for hello, or the
+// challenge certificate if hello is a TLS-ALPN-01 challenge
+func (s *Server) acmeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme == nil {
+		return nil, fmt.Errorf("acme is not configured")
+	}
+	return s.acme.manager.GetCertificate(hello)
+}
+
+func isACMETLSChallenge(state tls.ConnectionState) bool {
+	return state.NegotiatedProtocol == acme.ALPNProto
+}
@@ -0,0 +1,94 @@
+package tcprouter
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMECache(t *testing.T) {
+	ctx := context.Background()
+	cache := acmeCache{kv: newMemStore()}
+
+	_, err := cache.Get(ctx, "example.com")
+	assert.Equal(t, err, autocert.ErrCacheMiss)
+
+	require.NoError(t, cache.Put(ctx, "example.com", []byte("cert")))
+	data, err := cache.Get(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, data, []byte("cert"))
+
+	require.NoError(t, cache.Delete(ctx, "example.com"))
+	_, err = cache.Get(ctx, "example.com")
+	assert.Equal(t, err, autocert.ErrCacheMiss)
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	kv := newMemStore()
+	s := NewServer(ServerOptions{}, kv, map[string]Service{
+		"example.com": {Addr: "127.0.0.1", TerminateTLS: true, ACME: true},
+		"example.org": {Addr: "127.0.0.1", TerminateTLS: true},
+	})
+	var err error
+	s.acme, err = s.newACMEManager(ACMEConfig{Directory: "http://127.0.0.1:1/directory"})
+	require.NoError(t, err)
+
+	// the token is shared through the store by the instance that started the challenge
+	require.NoError(t, acmeCache{kv: kv}.Put(context.Background(), "token+http-01", []byte("token.thumbprint")))
+
+	get := func(host, path string) (int, string) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go s.handleHTTPConnection(pipeConn{server})
+
+		_, err := client.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("example.com", "/.well-known/acme-challenge/token")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, body, "token.thumbprint")
+
+	status, _ = get("EXAMPLE.com:80", "/.well-known/acme-challenge/unknown")
+	assert.Equal(t, status, http.StatusNotFound)
+
+	assert.Equal(t, s.isACMEChallenge(httptest.NewRequest(http.MethodGet, "http://example.org/.well-known/acme-challenge/token", nil)), false)
+	assert.Equal(t, s.isACMEChallenge(httptest.NewRequest(http.MethodGet, "http://example.com/index.html", nil)), false)
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"example.com":    {Addr: "127.0.0.1", TerminateTLS: true, ACME: true},
+		"*.example.org":  {Addr: "127.0.0.1", TerminateTLS: true, ACME: true},
+		catchAllService:  {Addr: "127.0.0.1", TerminateTLS: true, ACME: true},
+		"www.example.io": {Addr: "127.0.0.1", TerminateTLS: true},
+	})
+	ctx := context.Background()
+
+	require.NoError(t, s.acmeHostPolicy(ctx, "EXAMPLE.com:443"))
+	// names only served by a wildcard service or CATCH_ALL are refused
+	require.Error(t, s.acmeHostPolicy(ctx, "www.example.org"))
+	require.Error(t, s.acmeHostPolicy(ctx, "*.example.org"))
+	require.Error(t, s.acmeHostPolicy(ctx, "attacker.net"))
+	require.Error(t, s.acmeHostPolicy(ctx, catchAllService))
+	require.Error(t, s.acmeHostPolicy(ctx, "www.example.io"))
+}
+
+func TestACMEValidate(t *testing.T) {
+	require.NoError(t, Service{Addr: "127.0.0.1", TerminateTLS: true, ACME: true}.validate())
+	require.Error(t, Service{Addr: "127.0.0.1", ACME: true}.validate())
+}
@@ -0,0 +1,39 @@
+package tcprouter
+
+// alpnRoute returns the route of the service selected by the ALPN protocols
+// offered by the client. Protocols are tried in the order of preference of the client.
+// The route inherits the security settings of the service it doesn't set, see inherit
+func (s Service) alpnRoute(protocols []string) (Service, string, bool) {
+	for _, proto := range protocols {
+		if routed, ok := s.ALPN[proto]; ok {
+			return routed.inherit(s), proto, true
+		}
+	}
+	return Service{}, "", false
+}
+
+// inherit returns the route with the access lists, timeouts and TLS termination of parent
+// when it doesn't set its own, so selecting a route never loosens the rules of its service.
+// The limits of the parent are not copied, they are enforced under the name of the parent
+func (s Service) inherit(parent Service) Service {
+	if !s.Access.isSet() {
+		s.Access = parent.Access
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = parent.IdleTimeout
+	}
+	if s.MaxLifetime == 0 {
+		s.MaxLifetime = parent.MaxLifetime
+	}
+	if parent.TerminateTLS && !s.TerminateTLS {
+		s.TerminateTLS = true
+		s.CertFile, s.KeyFile, s.ACME = parent.CertFile, parent.KeyFile, parent.ACME
+		s.UpstreamTLS = parent.UpstreamTLS
+	}
+	return s
+}
+
+// alpnServiceName returns the name under which the route of service name selected by proto is registered
+func alpnServiceName(name, proto string) string {
+	return name + "|alpn=" + proto
+}
@@ -0,0 +1,194 @@
+package tcprouter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+		conn.Handshake()
+		client.Close()
+	}()
+
+	hello, isTLS, peeked := peekClientHello(bufio.NewReader(server))
+	assert.Equal(t, isTLS, true)
+	assert.Equal(t, hello.serverName, "example.com")
+	assert.Equal(t, hello.protocols, []string{"h2", "http/1.1"})
+	assert.Equal(t, peeked != "", true)
+}
+
+func TestALPNRouting(t *testing.T) {
+	// accepted reports on which backend a connection arrived
+	accepted := make(chan string, 1)
+	var backends []net.Listener
+	defer func() {
+		for _, l := range backends {
+			l.Close()
+		}
+	}()
+	backend := func(name string) int {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		backends = append(backends, l)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- name
+				conn.Close()
+			}
+		}()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"example.com": {
+			Addr:    "127.0.0.1",
+			TLSPort: backend("default"),
+			ALPN: map[string]Service{
+				"acme-tls/1": {Addr: "127.0.0.1", TLSPort: backend("acme")},
+				"http/1.1":   {Addr: "127.0.0.1", TLSPort: backend("http1")},
+			},
+		},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn.(*net.TCPConn))
+		}
+	}()
+
+	route := func(protos ...string) string {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		go tls.Client(conn, &tls.Config{ServerName: "example.com", NextProtos: protos}).Handshake()
+
+		select {
+		case name := <-accepted:
+			return name
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	assert.Equal(t, route(), "default")
+	assert.Equal(t, route("acme-tls/1"), "acme")
+	assert.Equal(t, route("h2", "http/1.1"), "http1")
+	assert.Equal(t, route("h2"), "default")
+}
+
+func TestALPNRouteInherit(t *testing.T) {
+	service := Service{
+		Addr:         "127.0.0.1",
+		TerminateTLS: true,
+		ACME:         true,
+		Access:       AccessConfig{Allow: []string{"10.0.0.0/8"}},
+		Limits:       ServiceLimits{MaxConnections: 1},
+		IdleTimeout:  30,
+		ALPN: map[string]Service{
+			"h2":       {Addr: "127.0.0.2"},
+			"http/1.1": {Addr: "127.0.0.3", Access: AccessConfig{Deny: []string{"10.0.0.1"}}, IdleTimeout: 60},
+		},
+	}
+
+	routed, _, ok := service.alpnRoute([]string{"h2"})
+	assert.Equal(t, ok, true)
+	assert.Equal(t, routed.Addr, "127.0.0.2")
+	assert.Equal(t, routed.Access, service.Access)
+	assert.Equal(t, routed.IdleTimeout, uint(30))
+	assert.Equal(t, routed.TerminateTLS, true)
+	assert.Equal(t, routed.ACME, true)
+	// the limits of the parent are enforced under its own name
+	assert.Equal(t, routed.Limits, ServiceLimits{})
+
+	routed, _, ok = service.alpnRoute([]string{"http/1.1"})
+	assert.Equal(t, ok, true)
+	assert.Equal(t, routed.Access, AccessConfig{Deny: []string{"10.0.0.1"}})
+	assert.Equal(t, routed.IdleTimeout, uint(60))
+}
+
+func TestALPNRouteAccessAndLimits(t *testing.T) {
+	accepted := make(chan struct{}, 4)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			// keep the connection open to hold the limit
+			go func() {
+				defer conn.Close()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	port := backend.Addr().(*net.TCPAddr).Port
+
+	route := Service{Addr: "127.0.0.1", TLSPort: port}
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"denied.com":  {Addr: "127.0.0.1", TLSPort: port, Access: AccessConfig{Deny: []string{"127.0.0.1"}}, ALPN: map[string]Service{"h2": route}},
+		"limited.com": {Addr: "127.0.0.1", TLSPort: port, Limits: ServiceLimits{MaxConnections: 1}, ALPN: map[string]Service{"h2": route}},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn.(*net.TCPConn))
+		}
+	}()
+
+	connect := func(serverName string, protos ...string) (net.Conn, bool) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		go tls.Client(conn, &tls.Config{ServerName: serverName, NextProtos: protos}).Handshake()
+		select {
+		case <-accepted:
+			return conn, true
+		case <-time.After(500 * time.Millisecond):
+			return conn, false
+		}
+	}
+
+	// the route of a denied service is denied too
+	conn, ok := connect("denied.com", "h2")
+	conn.Close()
+	assert.Equal(t, ok, false)
+
+	// the route counts against the limit of its service
+	first, ok := connect("limited.com")
+	defer first.Close()
+	assert.Equal(t, ok, true)
+	conn, ok = connect("limited.com", "h2")
+	conn.Close()
+	assert.Equal(t, ok, false)
+}
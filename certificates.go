@@ -0,0 +1,215 @@
+package tcprouter
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// certificates loaded from the db backend are reloaded after this delay
+	certificateCacheTTL = 5 * time.Minute
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// CertificatePair is the representation of a certificate stored in the db backend
+// under the key tcprouter/certificate/<domain>
+type CertificatePair struct {
+	// Cert is the PEM encoded certificate chain
+	Cert string `json:"cert"`
+	// Key is the PEM encoded private key
+	Key string `json:"key"`
+}
+
+func certificateKey(name string) string {
+	return fmt.Sprintf("tcprouter/certificate/%s", name)
+}
+
+type cachedCertificate struct {
+	cert     *tls.Certificate
+	loadedAt time.Time
+	// modification time of the certificate file, zero for certificates from the db backend
+	modTime time.Time
+}
+
+// certificateStore loads the certificates used to terminate TLS connections
+// from files or from the db backend and keeps them in memory
+type certificateStore struct {
+	kv  store.Store
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedCertificate
+	pools map[string]cachedPool
+	// swept is the last time the expired certificates of the db backend were evicted
+	swept time.Time
+}
+
+func newCertificateStore(kv store.Store) *certificateStore {
+	return &certificateStore{
+		kv:    kv,
+		now:   time.Now,
+		cache: make(map[string]cachedCertificate),
+		pools: make(map[string]cachedPool),
+	}
+}
+
+// fromFiles returns the certificate stored in certFile and keyFile,
+// it is reloaded when the certificate file changes
+func (c *certificateStore) fromFiles(certFile, keyFile string) (*tls.Certificate, error) {
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "file:" + certFile + ":" + keyFile
+	c.mu.Lock()
+	cached, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", certFile, err)
+	}
+
+	c.mu.Lock()
+	c.cache[key] = cachedCertificate{cert: &cert, loadedAt: time.Now(), modTime: info.ModTime()}
+	c.mu.Unlock()
+	return &cert, nil
+}
+
+// fromStore returns the certificate stored in the db backend for serverName,
+// a certificate stored for a matching wildcard name is used if there is no exact match
+func (c *certificateStore) fromStore(serverName string) (*tls.Certificate, error) {
+	for _, name := range hostCandidates(serverName) {
+		key := "kv:" + name
+		c.mu.Lock()
+		cached, ok := c.cache[key]
+		c.mu.Unlock()
+		if ok && c.now().Sub(cached.loadedAt) < certificateCacheTTL {
+			if cached.cert == nil {
+				continue
+			}
+			return cached.cert, nil
+		}
+
+		cert, err := c.load(name)
+		if err != nil {
+			log.Debug().Err(err).Str("name", name).Msg("no certificate in db backend")
+		}
+
+		c.mu.Lock()
+		c.sweepLocked()
+		c.cache[key] = cachedCertificate{cert: cert, loadedAt: c.now()}
+		c.mu.Unlock()
+		if cert != nil {
+			return cert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no certificate found for %s", serverName)
+}
+
+func (c *certificateStore) load(name string) (*tls.Certificate, error) {
+	if c.kv == nil {
+		return nil, fmt.Errorf("no db backend configured")
+	}
+
+	pair, err := c.kv.Get(certificateKey(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored CertificatePair
+	if err := json.Unmarshal(pair.Value, &stored); err != nil {
+		return nil, fmt.Errorf("invalid certificate content: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(stored.Cert), []byte(stored.Key))
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// sweepLocked evicts the expired certificates of the db backend, including the names without
+// certificate that any client can make up, at most once per cache TTL.
+// It must be called with the lock held
+func (c *certificateStore) sweepLocked() {
+	now := c.now()
+	if now.Sub(c.swept) < certificateCacheTTL {
+		return
+	}
+	c.swept = now
+	for key, cached := range c.cache {
+		if cached.modTime.IsZero() && now.Sub(cached.loadedAt) >= certificateCacheTTL {
+			delete(c.cache, key)
+		}
+	}
+}
+
+// certificate returns the certificate to present to clients of service asking for serverName
+func (s *Server) certificate(hello *tls.ClientHelloInfo, serverName string, service Service) (*tls.Certificate, error) {
+	if service.ACME {
+		return s.acmeCertificate(hello)
+	}
+	if service.CertFile != "" {
+		return s.certificates.fromFiles(service.CertFile, service.KeyFile)
+	}
+	return s.certificates.fromStore(serverName)
+}
+
+// terminateTLS completes the TLS handshake with the client of service and returns
+// the decrypted connection
+func (s *Server) terminateTLS(incoming WriteCloser, serverName string, service Service) (WriteCloser, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.certificate(hello, serverName, service)
+		},
+	}
+	if service.ACME {
+		// only TLS-ALPN-01 challenges negotiate a protocol, the other clients
+		// must not fail the handshake because of the protocols they offer
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					challenge := cfg.Clone()
+					challenge.GetConfigForClient = nil
+					challenge.NextProtos = []string{acme.ALPNProto}
+					return challenge, nil
+				}
+			}
+			return nil, nil
+		}
+	}
+
+	conn := tls.Server(incoming, cfg)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if isACMETLSChallenge(conn.ConnectionState()) {
+		log.Info().Str("server name", serverName).Msg("acme tls-alpn-01 challenge")
+		conn.Close()
+		return nil, errACMEChallenge
+	}
+
+	log.Info().
+		Str("server name", serverName).
+		Str("version", fmt.Sprintf("%x", conn.ConnectionState().Version)).
+		Msg("tls terminated")
+	return conn, nil
+}
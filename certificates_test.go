@@ -0,0 +1,149 @@
+package tcprouter
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCert generates a PEM encoded self signed certificate valid for names
+func selfSignedCert(t *testing.T, names ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// lineEcho starts a TCP server answering a single line with the same line
+func lineEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTerminateTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM := selfSignedCert(t, "example.com")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	backend := lineEcho(t)
+	defer backend.Close()
+
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"example.com": {
+			Addr:         "127.0.0.1",
+			HTTPPort:     backend.Addr().(*net.TCPAddr).Port,
+			TerminateTLS: true,
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+		},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.handleConnection(conn.(*net.TCPConn))
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "example.com", RootCAs: roots})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+}
+
+func TestCertificateFromStore(t *testing.T) {
+	kv := newMemStore()
+	certPEM, keyPEM := selfSignedCert(t, "*.example.com")
+	value, err := json.Marshal(CertificatePair{Cert: string(certPEM), Key: string(keyPEM)})
+	require.NoError(t, err)
+	require.NoError(t, kv.Put(certificateKey("*.example.com"), value, nil))
+
+	certs := newCertificateStore(kv)
+	cert, err := certs.fromStore("www.example.com")
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, leaf.DNSNames, []string{"*.example.com"})
+
+	_, err = certs.fromStore("example.org")
+	require.Error(t, err)
+
+	// the names without certificate are evicted once expired
+	now := time.Now()
+	certs.now = func() time.Time { return now }
+	for i := 0; i < 10; i++ {
+		_, err = certs.fromStore(fmt.Sprintf("host%d.example.org", i))
+		require.Error(t, err)
+	}
+	now = now.Add(certificateCacheTTL)
+	_, err = certs.fromStore("www.example.com")
+	require.NoError(t, err)
+	// only www.example.com and *.example.com are cached again
+	assert.Equal(t, len(certs.cache), 2)
+}
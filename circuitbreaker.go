@@ -0,0 +1,179 @@
+package tcprouter
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultCircuitBreakerCoolDown = 30
+	defaultCircuitBreakerTrials   = 1
+)
+
+// CircuitBreakerConfig configures the passive failure detection of the backends of a service
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failures after which a backend is ejected.
+	// 0 disables the circuit breaker
+	Failures int `toml:"failures"`
+	// CoolDown is the time in seconds a backend stays ejected before trial connections are sent to it
+	CoolDown uint `toml:"cooldown"`
+	// Trials is the number of concurrent trial connections allowed once the cool down is over
+	Trials int `toml:"trials"`
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker ejects a backend after too many consecutive failures.
+// Once the cool down is over the circuit is half open: a limited number of trial
+// connections are let through, the first success closes the circuit and a failure opens it again
+type circuitBreaker struct {
+	cfg CircuitBreakerConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig) *circuitBreaker {
+	if cfg.CoolDown == 0 {
+		cfg.CoolDown = defaultCircuitBreakerCoolDown
+	}
+	if cfg.Trials <= 0 {
+		cfg.Trials = defaultCircuitBreakerTrials
+	}
+	return &circuitBreaker{cfg: cfg, now: time.Now}
+}
+
+func (c *circuitBreaker) coolDownOver() bool {
+	return c.now().Sub(c.openedAt) >= time.Duration(c.cfg.CoolDown)*time.Second
+}
+
+// available returns true if a new connection can be sent to the backend
+func (c *circuitBreaker) available() bool {
+	if c.cfg.Failures <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		return c.coolDownOver()
+	case circuitHalfOpen:
+		return c.trials < c.cfg.Trials
+	default:
+		return true
+	}
+}
+
+// acquire records that a new connection is sent to the backend
+func (c *circuitBreaker) acquire() {
+	if c.cfg.Failures <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == circuitOpen && c.coolDownOver() {
+		c.state = circuitHalfOpen
+		c.trials = 0
+	}
+	if c.state == circuitHalfOpen {
+		c.trials++
+	}
+}
+
+// report records the outcome of a connection to the backend
+func (c *circuitBreaker) report(addr string, failed bool) {
+	if c.cfg.Failures <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == circuitHalfOpen && c.trials > 0 {
+		c.trials--
+	}
+
+	if !failed {
+		if c.state != circuitClosed {
+			log.Info().Str("backend", addr).Msg("circuit closed")
+		}
+		c.state = circuitClosed
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || (c.state == circuitClosed && c.failures >= c.cfg.Failures) {
+		log.Warn().
+			Str("backend", addr).
+			Int("failures", c.failures).
+			Msgf("circuit opened for %ds", c.cfg.CoolDown)
+		c.state = circuitOpen
+		c.openedAt = c.now()
+	}
+}
+
+// monitoredConn records whether a connection to a backend failed before
+// the backend sent anything, which is how dead or overloaded backends usually behave
+type monitoredConn struct {
+	WriteCloser
+	// received, if set, is called once the backend sent its first bytes
+	received func()
+
+	mu     sync.Mutex
+	read   int64
+	err    error
+	closed bool
+}
+
+// Read reads from the backend and records the outcome
+func (c *monitoredConn) Read(p []byte) (int, error) {
+	n, err := c.WriteCloser.Read(p)
+
+	c.mu.Lock()
+	first := c.read == 0 && n > 0
+	c.read += int64(n)
+	if err != nil && err != io.EOF && !c.closed && c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	if first && c.received != nil {
+		c.received()
+	}
+	return n, err
+}
+
+// Close closes the connection. Errors happening after this call are not recorded
+func (c *monitoredConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	return c.WriteCloser.Close()
+}
+
+// failed returns true if the connection got reset before receiving anything
+func (c *monitoredConn) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.read == 0 && c.err != nil
+}
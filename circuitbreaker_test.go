@@ -0,0 +1,137 @@
+package tcprouter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	c := newCircuitBreaker(CircuitBreakerConfig{Failures: 2, CoolDown: 10})
+	c.now = func() time.Time { return now }
+
+	c.acquire()
+	c.report("a", true)
+	assert.Equal(t, c.available(), true)
+	c.acquire()
+	c.report("a", true)
+	assert.Equal(t, c.available(), false)
+
+	// half open after the cool down, a single trial connection is allowed
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, c.available(), true)
+	c.acquire()
+	assert.Equal(t, c.available(), false)
+
+	// a failed trial opens the circuit again
+	c.report("a", true)
+	assert.Equal(t, c.available(), false)
+
+	now = now.Add(10 * time.Second)
+	c.acquire()
+	c.report("a", false)
+	assert.Equal(t, c.state, circuitClosed)
+	assert.Equal(t, c.available(), true)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	c := newCircuitBreaker(CircuitBreakerConfig{})
+	for i := 0; i < 10; i++ {
+		c.acquire()
+		c.report("a", true)
+	}
+	assert.Equal(t, c.available(), true)
+}
+
+type errConn struct {
+	net.Conn
+	data string
+	err  error
+}
+
+func (c *errConn) Read(p []byte) (int, error) {
+	if c.data != "" {
+		n := copy(p, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	return 0, c.err
+}
+
+func (c *errConn) Close() error      { return nil }
+func (c *errConn) CloseWrite() error { return nil }
+
+func TestMonitoredConn(t *testing.T) {
+	reset := errors.New("connection reset by peer")
+	tests := []struct {
+		conn   *errConn
+		close  bool
+		failed bool
+	}{
+		{conn: &errConn{err: reset}, failed: true},
+		{conn: &errConn{data: "hello", err: reset}, failed: false},
+		{conn: &errConn{err: io.EOF}, failed: false},
+		{conn: &errConn{err: reset}, close: true, failed: false},
+	}
+
+	for _, test := range tests {
+		mc := &monitoredConn{WriteCloser: test.conn}
+		if test.close {
+			mc.Close()
+		}
+		io.Copy(ioutil.Discard, mc)
+		assert.Equal(t, mc.failed(), test.failed)
+	}
+}
+
+func TestCircuitBreakerLongTrial(t *testing.T) {
+	port := closedPort(t)
+	service := Service{
+		Addr:           "127.0.0.1",
+		HTTPPort:       port,
+		CircuitBreaker: CircuitBreakerConfig{Failures: 1, CoolDown: 1},
+	}
+	s := NewServer(ServerOptions{}, nil, nil)
+	_, _, err := s.connectService("example.com", service, streamHeader{kind: streamTunnel}, nil, backendPort(false))
+	require.Error(t, err)
+	lb, err := s.balancer("example.com", service)
+	require.NoError(t, err)
+	assert.Equal(t, lb.breakers[0].available(), false)
+
+	// the backend is back and greets its clients, the trial connection stays open
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello\n"))
+		}
+	}()
+	time.Sleep(time.Second)
+
+	conn, release, err := s.connectService("example.com", service, streamHeader{kind: streamTunnel}, nil, backendPort(false))
+	require.NoError(t, err)
+	defer release()
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 6))
+	require.NoError(t, err)
+
+	// the circuit is closed as soon as the backend answered
+	lb.breakers[0].mu.Lock()
+	state := lb.breakers[0].state
+	lb.breakers[0].mu.Unlock()
+	assert.Equal(t, state, circuitClosed)
+	assert.Equal(t, lb.breakers[0].available(), true)
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-yamux"
 	"github.com/rs/zerolog/log"
@@ -15,24 +17,42 @@ import (
 type Client struct {
 	localAddr    string
 	localTLSAddr string
-	remoteAddr   string
+	localUDPAddr string
+	// local applications of the entrypoints, indexed by entrypoint name
+	localEntrypoints map[string]string
+	remoteAddr       string
 	// secret used to identify the connection in the tcp router server
 	secret []byte
 
 	// connection to the tcp router server
 	remoteSession *yamux.Session
+	// streamHeaders is set when the server agreed to start its streams with a streamHeader
+	streamHeaders bool
 }
 
 // NewClient creates a new TCP router client
 func NewClient(secret, local, localTLS, remote string) *Client {
 	return &Client{
-		localAddr:    local,
-		localTLSAddr: localTLS,
-		remoteAddr:   remote,
-		secret:       []byte(secret),
+		localAddr:        local,
+		localTLSAddr:     localTLS,
+		localEntrypoints: make(map[string]string),
+		remoteAddr:       remote,
+		secret:           []byte(secret),
 	}
 }
 
+// SetLocalUDPAddr sets the address of the local application receiving
+// the UDP datagrams forwarded by the router server
+func (c *Client) SetLocalUDPAddr(addr string) {
+	c.localUDPAddr = addr
+}
+
+// SetLocalEntrypointAddr sets the address of the local application receiving
+// the connections of the router server entrypoint name
+func (c *Client) SetLocalEntrypointAddr(name, addr string) {
+	c.localEntrypoints[name] = addr
+}
+
 // Start starts the client by opening a connection to the router server, doing the handshake
 // then start listening for incoming steam from the router server
 func (c Client) Start(ctx context.Context) error {
@@ -76,6 +96,10 @@ func (c *Client) connectRemote(addr string) error {
 }
 
 func (c *Client) connectLocal(addr string) (WriteCloser, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		return dialUnix(context.Background(), path)
+	}
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -106,7 +130,20 @@ func (c *Client) handshake() error {
 	}
 	defer stream.Close()
 
-	return h.Write(stream)
+	if err := h.Write(stream); err != nil {
+		return err
+	}
+	if err := writeFeatures(stream, featureStreamHeaders); err != nil {
+		return err
+	}
+	// older servers close the stream without answering, their streams carry no header
+	stream.SetReadDeadline(time.Now().Add(clientHandshakeTimeout))
+	features, err := readFeatures(stream)
+	if err != nil {
+		return err
+	}
+	c.streamHeaders = features&featureStreamHeaders != 0
+	return nil
 }
 
 func (c *Client) listen(ctx context.Context) error {
@@ -114,69 +151,184 @@ func (c *Client) listen(ctx context.Context) error {
 	defer cancel()
 
 	cCon := make(chan WriteCloser)
-	cErr := make(chan error)
+	cErr := make(chan error, 1)
 	go func(ctx context.Context, cCon chan<- WriteCloser, cErr chan<- error) {
 		for {
+			conn, err := c.remoteSession.AcceptStream()
+			if err != nil {
+				cErr <- err
+				return
+			}
 			select {
 			case <-ctx.Done():
+				conn.Close()
 				return
-			default:
-				conn, err := c.remoteSession.AcceptStream()
-				if err != nil {
-					cErr <- err
-					return
-				}
-				cCon <- WrapConn(conn)
+			case cCon <- WrapConn(conn):
 			}
 		}
 	}(ctx, cCon, cErr)
 
+	goAway := make(chan struct{})
+	var goAwayOnce sync.Once
+	onGoAway := func() {
+		goAwayOnce.Do(func() { close(goAway) })
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case err := <-cErr:
 			return fmt.Errorf("accept connection failed: %w", err)
+		case <-goAway:
+			// the session is left to the streams still forwarding, the server closes it once they are done
+			log.Info().Msg("router server is shutting down, reconnecting")
+			return nil
 		case remote := <-cCon:
-			log.Info().
-				Str("remote add", remote.RemoteAddr().String()).
-				Msg("incoming stream, connect to local application")
-
-			var err error
-			var local WriteCloser
-			br := bufio.NewReader(remote)
-			_, isTLS, peeked := clientHelloServerName(br)
-			if isTLS {
-				local, err = c.connectLocal(c.localTLSAddr)
-			} else {
-				local, err = c.connectLocal(c.localAddr)
+			go c.handleStream(remote, onGoAway)
+		}
+	}
+}
+
+// handleStream connects a stream of the router server to the local application it is meant for.
+// goAway is called when the stream tells the server is shutting down
+func (c *Client) handleStream(remote WriteCloser, goAway func()) {
+	log.Info().
+		Str("remote add", remote.RemoteAddr().String()).
+		Msg("incoming stream, connect to local application")
+
+	br := bufio.NewReader(remote)
+	// without stream headers the server only sends the http and tls traffic
+	hdr := streamHeader{kind: streamTunnel}
+	if c.streamHeaders {
+		if err := hdr.Read(br); err != nil {
+			log.Error().Err(err).Msg("failed to read stream header")
+			remote.Close()
+			return
+		}
+	}
+	switch hdr.kind {
+	case streamGoAway:
+		remote.Close()
+		goAway()
+		return
+	case streamUDP:
+		c.forwardUDP(remote, br)
+		return
+	}
+
+	var (
+		local    WriteCloser
+		err      error
+		proxyHdr []byte
+		peeked   string
+	)
+	if hdr.kind == streamEntrypoint {
+		// the application may talk first, the stream is forwarded without looking at its content
+		addr, ok := c.localEntrypoints[hdr.entrypoint]
+		if !ok {
+			log.Error().Str("entrypoint", hdr.entrypoint).Msg("received entrypoint traffic but no local application configured")
+			remote.Close()
+			return
+		}
+		buffered, _ := br.Peek(br.Buffered())
+		peeked = string(buffered)
+		local, err = c.connectLocal(addr)
+	} else {
+		if hdr.proxyHeader {
+			proxyHdr, err = readProxyHeader(br)
+			if err == nil && len(proxyHdr) == 0 {
+				err = fmt.Errorf("no header found")
 			}
 			if err != nil {
-				return fmt.Errorf("failed to connect to local application: %w", err)
+				log.Error().Err(err).Msg("failed to read proxy protocol header")
+				remote.Close()
+				return
 			}
-			incoming := GetConn(remote, peeked)
+		}
+		var isTLS bool
+		_, isTLS, peeked = clientHelloServerName(br)
+		if isTLS {
+			local, err = c.connectLocal(c.localTLSAddr)
+		} else {
+			local, err = c.connectLocal(c.localAddr)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to connect to local application")
+		remote.Close()
+		return
+	}
+	incoming := GetConn(remote, peeked)
+
+	// relay the proxy protocol header to the local application
+	if len(proxyHdr) > 0 {
+		if _, err := local.Write(proxyHdr); err != nil {
+			log.Error().Err(err).Msg("failed to relay proxy protocol header")
+			incoming.Close()
+			local.Close()
+			return
+		}
+	}
+
+	log.Info().Msg("start forwarding")
+
+	cErr := make(chan error)
+	go forward(local, incoming, cErr)
+	go forward(incoming, local, cErr)
+
+	err = <-cErr
+	if err != nil {
+		log.Error().Err(err).Msg("Error during forwarding: %w")
+	}
+
+	<-cErr
+
+	if err := incoming.Close(); err != nil {
+		log.Error().Err(err).Msg("Error while terminating connection")
+	}
+	if err := local.Close(); err != nil {
+		log.Error().Err(err).Msg("Error while terminating connection")
+	}
+}
+
+// forwardUDP forwards the datagrams carried by a stream of the router server
+// to the local UDP application and back
+func (c *Client) forwardUDP(remote WriteCloser, br *bufio.Reader) {
+	defer remote.Close()
 
-			go func(remote, local WriteCloser) {
-				log.Info().Msg("start forwarding")
+	if c.localUDPAddr == "" {
+		log.Error().Msg("received UDP traffic but no local UDP application configured")
+		return
+	}
 
-				cErr := make(chan error)
-				go forward(local, remote, cErr)
-				go forward(remote, local, cErr)
+	local, err := net.Dial("udp", c.localUDPAddr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to connect to local UDP application")
+		return
+	}
+	defer local.Close()
 
-				err = <-cErr
-				if err != nil {
-					log.Error().Err(err).Msg("Error during forwarding: %w")
-				}
+	stream := newDatagramStream(remote, br)
+	cErr := make(chan error, 2)
+	go func() { cErr <- copyDatagrams(local, stream) }()
+	go func() { cErr <- copyDatagrams(stream, local) }()
 
-				<-cErr
+	if err := <-cErr; err != nil && err != io.EOF {
+		log.Error().Err(err).Msg("Error during UDP forwarding")
+	}
+}
 
-				if err := remote.Close(); err != nil {
-					log.Error().Err(err).Msg("Error while terminating connection")
-				}
-				if err := local.Close(); err != nil {
-					log.Error().Err(err).Msg("Error while terminating connection")
-				}
-			}(incoming, local)
+// copyDatagrams copies datagrams one by one from src to dst
+func copyDatagrams(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return err
 		}
 	}
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -33,14 +35,24 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:    "local",
-			Usage:   "address to the local application",
+			Usage:   "address to the local application, host:port or unix:///path/to.sock",
 			EnvVars: []string{"TRC_LOCAL"},
 		},
 		&cli.StringFlag{
 			Name:    "local-tls",
-			Usage:   "address to the local tls application",
+			Usage:   "address to the local tls application, host:port or unix:///path/to.sock",
 			EnvVars: []string{"TRC_LOCAL"},
 		},
+		&cli.StringFlag{
+			Name:    "local-udp",
+			Usage:   "address to the local udp application",
+			EnvVars: []string{"TRC_LOCAL_UDP"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "entrypoint",
+			Usage:   "name=address of the local application of a router server entrypoint, host:port or unix:///path/to.sock, this flag can be used multiple time",
+			EnvVars: []string{"TRC_ENTRYPOINT"},
+		},
 		&cli.IntFlag{
 			Name:    "backoff",
 			Value:   5,
@@ -56,6 +68,15 @@ func main() {
 		if len(localtls) == 0 {
 			localtls = local
 		}
+		localudp := c.String("local-udp")
+		entrypoints := make(map[string]string)
+		for _, ep := range c.StringSlice("entrypoint") {
+			parts := strings.SplitN(ep, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("invalid entrypoint %s, expected name=address", ep)
+			}
+			entrypoints[parts[0]] = parts[1]
+		}
 		backoff := c.Int("backoff")
 		secret := c.String("secret")
 
@@ -69,11 +90,13 @@ func main() {
 
 		for _, remote := range remotes {
 			c := connection{
-				Secret:   secret,
-				Remote:   remote,
-				Local:    local,
-				LocalTLS: localtls,
-				Backoff:  backoff,
+				Secret:      secret,
+				Remote:      remote,
+				Local:       local,
+				LocalTLS:    localtls,
+				LocalUDP:    localudp,
+				Entrypoints: entrypoints,
+				Backoff:     backoff,
 			}
 			go func() {
 				defer func() {
@@ -103,11 +126,18 @@ type connection struct {
 	Remote   string
 	Local    string
 	LocalTLS string
-	Backoff  int
+	LocalUDP string
+	// Entrypoints are the local applications of the entrypoints, indexed by name
+	Entrypoints map[string]string
+	Backoff     int
 }
 
 func start(ctx context.Context, c connection) {
 	client := tcprouter.NewClient(c.Secret, c.Local, c.LocalTLS, c.Remote)
+	client.SetLocalUDPAddr(c.LocalUDP)
+	for name, addr := range c.Entrypoints {
+		client.SetLocalEntrypointAddr(name, addr)
+	}
 
 	op := func() error {
 		for {
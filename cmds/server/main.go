@@ -27,16 +27,13 @@ var validBackends = map[string]store.Backend{
 }
 
 func readConfig(path string) (tcprouter.Config, error) {
+	var c tcprouter.Config
 	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal().
-			Str("path", path).
-			Err(err).
-			Msg("failed to open configuration file")
+		return c, fmt.Errorf("failed to open configuration file %w", err)
 	}
 	defer f.Close()
 
-	var c tcprouter.Config
 	_, err = toml.DecodeReader(f, &c)
 	if err != nil {
 		return c, fmt.Errorf("failed to read configuration %w", err)
@@ -44,6 +41,26 @@ func readConfig(path string) (tcprouter.Config, error) {
 	return c, nil
 }
 
+// serverOptions returns the options of the server configured by cfg
+func serverOptions(cfg tcprouter.Config) tcprouter.ServerOptions {
+	return tcprouter.ServerOptions{
+		ListeningAddr:           cfg.Server.Host,
+		ListeningTLSPort:        cfg.Server.Port,
+		ListeningHTTPPort:       cfg.Server.HTTPPort,
+		ListeningForClientsPort: cfg.Server.ClientsPort,
+		ProxyProtocol:           cfg.Server.ProxyProtocol,
+		Entrypoints:             cfg.Server.Entrypoints,
+		UDPEntrypoints:          cfg.Server.UDPEntrypoints,
+		ACME:                    cfg.Server.ACME,
+		HTTP:                    cfg.Server.HTTP,
+		Access:                  cfg.Server.Access,
+		Limits:                  cfg.Server.Limits,
+		Timeouts:                cfg.Server.Timeouts,
+		DbRefresh:               cfg.Server.DbBackend.Refresh,
+		ServicesDir:             cfg.Server.ServicesDir,
+	}
+}
+
 func initBackend(cfg tcprouter.Config) error {
 	redis.Register()
 
@@ -101,25 +118,42 @@ func main() {
 				Msg("Cannot create backend store")
 		}
 
-		serverOpts := tcprouter.ServerOptions{
-			ListeningAddr:           cfg.Server.Host,
-			ListeningTLSPort:        cfg.Server.Port,
-			ListeningHTTPPort:       cfg.Server.HTTPPort,
-			ListeningForClientsPort: cfg.Server.ClientsPort,
-		}
+		serverOpts := serverOptions(cfg)
 		s := tcprouter.NewServer(serverOpts, kv, cfg.Server.Services)
 
 		cSig := make(chan os.Signal, 1)
 		signal.Notify(cSig, os.Interrupt, syscall.SIGTERM)
 
-		ctx, cancel := context.WithCancel(context.Background())
 		go func() {
 			// Block until a signal is received.
 			<-cSig
-			cancel()
+			ctx, cancel := context.WithTimeout(context.Background(), serverOpts.ShutdownTimeout())
+			defer cancel()
+			if cut, err := s.Shutdown(ctx); err != nil {
+				log.Warn().Err(err).Int("connections cut", cut).Msg("graceful shutdown incomplete")
+			}
+		}()
+
+		cHup := make(chan os.Signal, 1)
+		signal.Notify(cHup, syscall.SIGHUP)
+
+		go func() {
+			for range cHup {
+				log.Info().Str("path", cfgPath).Msg("reloading configuration")
+				cfg, err := readConfig(cfgPath)
+				if err != nil {
+					log.Error().Err(err).Msg("failed to reload configuration, keeping the current one")
+					continue
+				}
+				if err := s.Reload(serverOptions(cfg), cfg.Server.Services); err != nil {
+					log.Error().Err(err).Msg("failed to reload configuration")
+					continue
+				}
+				log.Info().Msg("configuration reloaded")
+			}
 		}()
 
-		return s.Start(ctx)
+		return s.Start(context.Background())
 	}
 
 	err := app.Run(os.Args)
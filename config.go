@@ -2,6 +2,8 @@ package tcprouter
 
 import (
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/abronan/valkeyrie/store"
 )
@@ -25,6 +27,38 @@ type ServerConfig struct {
 	ClientsPort uint               `toml:"clientsport"`
 	DbBackend   DbBackendConfig    `toml:"dbbackend"`
 	Services    map[string]Service `toml:"services"`
+
+	ProxyProtocol EntrypointsProxyProtocol `toml:"proxyprotocol"`
+
+	Entrypoints    map[string]EntrypointConfig    `toml:"entrypoints"`
+	UDPEntrypoints map[string]UDPEntrypointConfig `toml:"udpentrypoints"`
+
+	ACME ACMEConfig `toml:"acme"`
+	HTTP HTTPConfig `toml:"http"`
+	// Access restricts the sources allowed to reach the services that don't define their own lists
+	Access AccessConfig `toml:"access"`
+	// Limits caps the rate and number of connections accepted
+	Limits LimitsConfig `toml:"limits"`
+	// Timeouts bounds how long connections are kept open
+	Timeouts TimeoutsConfig `toml:"timeouts"`
+	// ServicesDir is a directory watched for TOML, JSON or YAML files defining services
+	ServicesDir string `toml:"servicesdir"`
+}
+
+// EntrypointsProxyProtocol configures the acceptance of PROXY protocol headers for each entrypoint
+type EntrypointsProxyProtocol struct {
+	HTTP    ProxyProtocolConfig `toml:"http"`
+	TLS     ProxyProtocolConfig `toml:"tls"`
+	Clients ProxyProtocolConfig `toml:"clients"`
+}
+
+// ProxyProtocolConfig configures how an entrypoint accepts PROXY protocol headers
+type ProxyProtocolConfig struct {
+	// Mode is one of "" (disabled), "optional" or "require"
+	Mode string `toml:"mode"`
+	// Trusted is the list of CIDRs allowed to send a PROXY protocol header.
+	// It is required when Mode is set
+	Trusted []string `toml:"trusted"`
 }
 
 // Addr returns the listenting address of the server
@@ -35,9 +69,115 @@ func (s ServerConfig) Addr() string {
 // Service defines a proxy configuration
 type Service struct {
 	Addr         string `toml:"addr"`
-	ClientSecret string `toml:"clientsecret` // will forward connection to it directly instead of hitting the Addr.
+	ClientSecret string `toml:"clientsecret"` // will forward connection to it directly instead of hitting the Addr.
 	TLSPort      int    `toml:"tlsport"`
 	HTTPPort     int    `toml:"httpport"`
+	// TCPPort is the port used when the service is reached from a TCP entrypoint.
+	// It defaults to the port of the entrypoint
+	TCPPort int `toml:"tcpport"`
+	// UDPPort is the port used when the service is reached from an UDP entrypoint.
+	// It defaults to the port of the entrypoint
+	UDPPort int `toml:"udpport"`
+	// ProxyProtocol is the version (1 or 2) of the PROXY protocol header to send
+	// in front of the forwarded traffic. 0 disables it.
+	ProxyProtocol int `toml:"proxyprotocol"`
+	// Backends is the list of targets to balance the traffic between.
+	// When set, it is used instead of Addr
+	Backends []Backend `toml:"backends"`
+	// LoadBalancer is the strategy used to choose a backend: roundrobin (default), weighted, leastconn or sourcehash
+	LoadBalancer string `toml:"loadbalancer"`
+	// HealthCheck configures the active health checking of the backends
+	HealthCheck HealthCheckConfig `toml:"healthcheck"`
+	// CircuitBreaker configures the ejection of failing backends
+	CircuitBreaker CircuitBreakerConfig `toml:"circuitbreaker"`
+	// Retries is the number of times a failed connection to a backend
+	// or a tunnel is retried on another backend or tunnel
+	Retries int `toml:"retries"`
+	// DialTimeout is the timeout in seconds of each connection attempt to a backend
+	DialTimeout uint `toml:"dialtimeout"`
+	// TerminateTLS makes the router terminate the TLS connections of the service
+	// and forward the plain traffic to the HTTP port of the backends
+	TerminateTLS bool `toml:"terminatetls"`
+	// CertFile and KeyFile are the certificate used to terminate TLS.
+	// If not set, the certificate is loaded from the db backend
+	CertFile string `toml:"certfile"`
+	KeyFile  string `toml:"keyfile"`
+	// ACME makes the router obtain and renew the certificate used to terminate TLS with ACME
+	ACME bool `toml:"acme"`
+	// UpstreamTLS configures the TLS connection to the backends when TLS is terminated
+	UpstreamTLS UpstreamTLSConfig `toml:"upstreamtls"`
+	// ALPN are alternative routes of the service indexed by ALPN protocol. The first
+	// protocol offered by a TLS client that has a route selects it
+	ALPN map[string]Service `toml:"alpn"`
+	// HTTPSRedirect is the status code (301 or 308) used to redirect plain HTTP requests
+	// to https. 0 uses the default of the HTTP listener and -1 disables the redirection
+	HTTPSRedirect int `toml:"httpsredirect"`
+	// Access restricts the sources allowed to reach the service,
+	// the access lists of the server are used if not set
+	Access AccessConfig `toml:"access"`
+	// Limits caps the rate and number of connections to the service
+	Limits ServiceLimits `toml:"limits"`
+	// IdleTimeout is the time in seconds after which connections without traffic are closed,
+	// the server default is used if not set
+	IdleTimeout uint `toml:"idletimeout"`
+	// MaxLifetime is the time in seconds after which connections are closed whatever their activity,
+	// the server default is used if not set
+	MaxLifetime uint `toml:"maxlifetime"`
+}
+
+func (s Service) validate() error {
+	if err := s.HealthCheck.validate(); err != nil {
+		return err
+	}
+	switch s.ProxyProtocol {
+	case 0, ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("unsupported proxyprotocol version %d", s.ProxyProtocol)
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return fmt.Errorf("certfile and keyfile must be set together")
+	}
+	if s.ACME && s.CertFile != "" {
+		return fmt.Errorf("acme and certfile can't be used together")
+	}
+	if s.ACME && !s.TerminateTLS {
+		return fmt.Errorf("acme requires terminatetls")
+	}
+	if s.UpstreamTLS.Enabled && !s.TerminateTLS {
+		return fmt.Errorf("upstreamtls requires terminatetls")
+	}
+	if err := s.UpstreamTLS.validate(); err != nil {
+		return err
+	}
+	if err := s.Access.validate(); err != nil {
+		return err
+	}
+	if err := s.Limits.validate(); err != nil {
+		return err
+	}
+	switch s.HTTPSRedirect {
+	case 0, -1, http.StatusMovedPermanently, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("unsupported httpsredirect status %d", s.HTTPSRedirect)
+	}
+	for proto, routed := range s.ALPN {
+		if len(routed.ALPN) != 0 {
+			return fmt.Errorf("alpn %s: alpn routes can't be nested", proto)
+		}
+		if err := routed.validate(); err != nil {
+			return fmt.Errorf("alpn %s: %w", proto, err)
+		}
+	}
+	return nil
+}
+
+const defaultDialTimeout = 10 * time.Second
+
+func (s Service) dialTimeout() time.Duration {
+	if s.DialTimeout == 0 {
+		return defaultDialTimeout
+	}
+	return time.Duration(s.DialTimeout) * time.Second
 }
 
 // DbBackendConfig define the connection to a backend store
@@ -66,6 +66,9 @@ func testEnd2End(t *testing.T, size int) {
 		require.NoError(t, err)
 	}()
 
+	// the client gives up when the server is not listening yet
+	waitListening(t, fmt.Sprintf("%s:%d", domain, clientPort))
+
 	// start tcprouter client
 	u, err := url.Parse(localApp.URL)
 	require.NoError(t, err)
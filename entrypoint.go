@@ -0,0 +1,88 @@
+package tcprouter
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EntrypointConfig defines a listener that forwards all the TCP traffic it receives
+// to a single service, without looking at the content of the connections
+type EntrypointConfig struct {
+	// Addr is the listening address, default to the address of the server
+	Addr          string              `toml:"addr"`
+	Port          uint                `toml:"port"`
+	ProxyProtocol ProxyProtocolConfig `toml:"proxyprotocol"`
+	Service       Service             `toml:"service"`
+}
+
+func (e EntrypointConfig) validate() error {
+	if e.Port == 0 {
+		return fmt.Errorf("no port configured")
+	}
+	if e.Service.ClientSecret == "" && e.Service.Addr == "" && len(e.Service.Backends) == 0 {
+		return fmt.Errorf("no backend or client secret configured")
+	}
+	return nil
+}
+
+// service returns the service of the entrypoint, its backends default to the port of the entrypoint
+func (e EntrypointConfig) service() Service {
+	service := e.Service
+	if service.TCPPort == 0 {
+		service.TCPPort = int(e.Port)
+	}
+	return service
+}
+
+// EntrypointAddr returns the listening address of an entrypoint
+func (o ServerOptions) EntrypointAddr(ep EntrypointConfig) string {
+	addr := ep.Addr
+	if addr == "" {
+		addr = o.ListeningAddr
+	}
+	return fmt.Sprintf("%s:%d", addr, ep.Port)
+}
+
+// entrypointServiceName is the name under which the service of an entrypoint is registered
+func entrypointServiceName(name string) string {
+	return "entrypoint/" + name
+}
+
+func (s *Server) entrypointHandler(name string, ep EntrypointConfig) Handler {
+	serviceName := entrypointServiceName(name)
+	service := ep.service()
+	port := func(b Backend) int { return b.TCPPort }
+
+	return HandlerFunc(func(conn WriteCloser) {
+		log.Info().
+			Str("entrypoint", name).
+			Str("remote addr", conn.RemoteAddr().String()).
+			Msg("new connection")
+
+		if err := s.checkAccess(service, conn.RemoteAddr()); err != nil {
+			logAccessDenied(err, serviceName, conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		limited, err := s.limiter.acquireService(serviceName, service.Limits)
+		if err != nil {
+			s.reject(conn, trafficTCP, err)
+			return
+		}
+		defer limited()
+
+		stream := streamHeader{kind: streamEntrypoint, entrypoint: name}
+		outgoing, release, err := s.connectService(serviceName, service, stream, conn.RemoteAddr(), port)
+		if err != nil {
+			conn.Close()
+			log.Error().Err(err).Str("entrypoint", name).Msg("error forwarding traffic")
+			return
+		}
+		defer release()
+
+		if err := proxy(conn, outgoing, service, "", s.timeouts(service)); err != nil {
+			log.Error().Err(err).Str("entrypoint", name).Msg("error forwarding traffic")
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package tcprouter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntrypoint(t *testing.T) {
+	// echo backend
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+
+	port := closedPort(t)
+	s := NewServer(ServerOptions{
+		ListeningAddr: "127.0.0.1",
+		Entrypoints: map[string]EntrypointConfig{
+			"echo": {
+				Port: uint(port),
+				Service: Service{
+					Addr:    "127.0.0.1",
+					TCPPort: backend.Addr().(*net.TCPAddr).Port,
+				},
+			},
+		},
+	}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		require.NoError(t, s.Start(ctx))
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	waitListening(t, addr)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+}
+
+func TestEntrypointTunnel(t *testing.T) {
+	// backend talking first, like SMTP or MySQL
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("220 ready\n"))
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+
+	const secret = "secret"
+	greeterPort, downPort, clientsPort := closedPort(t), closedPort(t), closedPort(t)
+	s := NewServer(ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        uint(closedPort(t)),
+		ListeningHTTPPort:       uint(closedPort(t)),
+		ListeningForClientsPort: uint(clientsPort),
+		Entrypoints: map[string]EntrypointConfig{
+			"greeter": {Port: uint(greeterPort), Service: Service{ClientSecret: secret}},
+			"down":    {Port: uint(downPort), Service: Service{ClientSecret: secret}},
+		},
+	}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+	clientsAddr := fmt.Sprintf("127.0.0.1:%d", clientsPort)
+	waitListening(t, clientsAddr)
+
+	client := NewClient(secret, "", "", clientsAddr)
+	client.SetLocalEntrypointAddr("greeter", backend.Addr().String())
+	client.SetLocalEntrypointAddr("down", fmt.Sprintf("127.0.0.1:%d", closedPort(t)))
+	go client.Start(ctx)
+	for i := 0; i < 50 && len(s.sessions(secret)) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	dial := func(port int) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	// a failing local application only closes its stream
+	conn, br := dial(downPort)
+	_, err = br.ReadString('\n')
+	require.Error(t, err)
+	conn.Close()
+
+	// a silent stream doesn't block the following ones
+	idle, idleReader := dial(greeterPort)
+	defer idle.Close()
+	conn, br = dial(greeterPort)
+	defer conn.Close()
+	for _, r := range []*bufio.Reader{br, idleReader} {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, line, "220 ready\n")
+	}
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+}
+
+func TestEntrypointValidate(t *testing.T) {
+	require.Error(t, EntrypointConfig{Service: Service{Addr: "127.0.0.1"}}.validate())
+	require.Error(t, EntrypointConfig{Port: 22}.validate())
+	require.NoError(t, EntrypointConfig{Port: 22, Service: Service{ClientSecret: "secret"}}.validate())
+}
+
+func TestEntrypointStreamSpoofing(t *testing.T) {
+	local := lineEcho(t)
+	defer local.Close()
+	ssh, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ssh.Close()
+	go func() {
+		for {
+			conn, err := ssh.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ssh\n"))
+			conn.Close()
+		}
+	}()
+
+	const secret = "secret"
+	tlsPort, clientsPort := closedPort(t), closedPort(t)
+	s := NewServer(ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        uint(tlsPort),
+		ListeningHTTPPort:       uint(closedPort(t)),
+		ListeningForClientsPort: uint(clientsPort),
+		Entrypoints: map[string]EntrypointConfig{
+			"ssh": {Port: uint(closedPort(t)), Service: Service{ClientSecret: secret}},
+		},
+	}, nil, map[string]Service{catchAllService: {ClientSecret: secret}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+	clientsAddr := fmt.Sprintf("127.0.0.1:%d", clientsPort)
+	waitListening(t, clientsAddr)
+
+	client := NewClient(secret, local.Addr().String(), local.Addr().String(), clientsAddr)
+	client.SetLocalEntrypointAddr("ssh", ssh.Addr().String())
+	go client.Start(ctx)
+	for i := 0; i < 50 && len(s.sessions(secret)) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the bytes sent by a client are never taken for a stream header
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tlsPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write([]byte("\x00TCP\x03ssh\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "\x00TCP\x03ssh\n")
+}
+
+func TestEntrypointHealthCheckPort(t *testing.T) {
+	check := HealthCheckConfig{Type: HealthCheckTCP}
+	ep := EntrypointConfig{Port: 2222, Service: Service{Addr: "127.0.0.1", HealthCheck: check}}
+	assert.Equal(t, check.addr(ep.service().Targets()[0]), "127.0.0.1:2222")
+
+	udp := UDPEntrypointConfig{Port: 53, Service: Service{Backends: []Backend{{Addr: "127.0.0.1"}}, HealthCheck: check}}
+	assert.Equal(t, check.addr(udp.service().Targets()[0]), "127.0.0.1:53")
+
+	ep.Service.TCPPort = 22
+	assert.Equal(t, check.addr(ep.service().Targets()[0]), "127.0.0.1:22")
+}
@@ -6,10 +6,13 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/abronan/valkeyrie v0.0.0-20191010124425-1ae9442de16e
 	github.com/cenkalti/backoff/v3 v3.1.1
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/libp2p/go-yamux v1.2.4
 	github.com/magiconair/properties v1.8.1
 	github.com/rs/zerolog v1.15.0
 	github.com/stretchr/testify v1.3.0
 	github.com/urfave/cli/v2 v2.1.1
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	gopkg.in/yaml.v2 v2.2.2
 )
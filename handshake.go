@@ -2,13 +2,18 @@ package tcprouter
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
+	"time"
 )
 
 const (
 	// MagicNr is the bytes sent during handshake to identity a tcprouter client connection
 	// TODO: chose a valid magic number
 	MagicNr = 0x1111
+
+	// clientHandshakeTimeout bounds the time given to the peer to answer during the handshake
+	clientHandshakeTimeout = 10 * time.Second
 )
 
 // Handshake is the struct used to serialize the first frame sent to the server
@@ -47,3 +52,98 @@ func (h *Handshake) Read(r io.Reader) error {
 	copy(h.Secret, b[:n])
 	return nil
 }
+
+// featureStreamHeaders is sent by the clients after the handshake to ask the server to start
+// every stream it opens with a stream header. The server acknowledges it by sending it back,
+// servers that don't know it close the handshake stream instead
+const featureStreamHeaders byte = 0x01
+
+// readFeatures reads the features byte sent after the handshake.
+// Peers that don't send one close the stream, 0 is returned for them
+func readFeatures(r io.Reader) (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func writeFeatures(w io.Writer, features byte) error {
+	_, err := w.Write([]byte{features})
+	return err
+}
+
+// streamKind tells trc what kind of traffic a stream opened by the server carries
+type streamKind byte
+
+const (
+	// streamTunnel carries a connection received on the http or tls listener
+	streamTunnel streamKind = iota + 1
+	// streamEntrypoint carries a connection received on an entrypoint
+	streamEntrypoint
+	// streamUDP carries the datagrams of an udp flow
+	streamUDP
+	// streamGoAway is sent when the server shuts down, trc reconnects right away
+	// while the streams already opened are finishing
+	streamGoAway
+)
+
+// streamHasProxyHeader is set on the kind of the streams starting with a PROXY protocol header
+const streamHasProxyHeader = 0x80
+
+// streamHeader is written by the server at the beginning of the streams it opens on the sessions
+// that negotiated featureStreamHeaders. Nothing else is written on a stream before it, so trc
+// never mistakes bytes chosen by a remote client for a header
+type streamHeader struct {
+	kind streamKind
+	// entrypoint is the name of the entrypoint of the streamEntrypoint streams
+	entrypoint string
+	// proxyHeader is set when a PROXY protocol header follows
+	proxyHeader bool
+}
+
+func (h streamHeader) Write(w io.Writer) error {
+	if len(h.entrypoint) > 255 {
+		return fmt.Errorf("entrypoint name %s is too long", h.entrypoint)
+	}
+	kind := byte(h.kind)
+	if h.proxyHeader {
+		kind |= streamHasProxyHeader
+	}
+	b := []byte{kind}
+	if h.kind == streamEntrypoint {
+		b = append(b, byte(len(h.entrypoint)))
+		b = append(b, h.entrypoint...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (h *streamHeader) Read(r io.Reader) error {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	h.kind = streamKind(b[0] &^ streamHasProxyHeader)
+	h.proxyHeader = b[0]&streamHasProxyHeader != 0
+	switch h.kind {
+	case streamTunnel, streamUDP, streamGoAway:
+		return nil
+	case streamEntrypoint:
+	default:
+		return fmt.Errorf("unknown stream kind %d", h.kind)
+	}
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	name := make([]byte, b[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return err
+	}
+	h.entrypoint = string(name)
+	return nil
+}
@@ -61,3 +61,23 @@ func TestHandshake(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestStreamHeaderEncodeDecode(t *testing.T) {
+	for _, h := range []streamHeader{
+		{kind: streamTunnel},
+		{kind: streamTunnel, proxyHeader: true},
+		{kind: streamEntrypoint, entrypoint: "ssh"},
+		{kind: streamUDP},
+		{kind: streamGoAway},
+	} {
+		b := bytes.Buffer{}
+		require.NoError(t, h.Write(&b))
+
+		h2 := streamHeader{}
+		require.NoError(t, h2.Read(&b))
+		assert.Equal(t, h2, h)
+		assert.Equal(t, b.Len(), 0)
+	}
+
+	require.Error(t, (&streamHeader{}).Read(bytes.NewReader([]byte{0})))
+}
@@ -0,0 +1,360 @@
+package tcprouter
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Types of active health checks
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckTLS  = "tls"
+	HealthCheckHTTP = "http"
+)
+
+const (
+	defaultHealthCheckInterval = 10
+	defaultHealthCheckTimeout  = 5
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+// HealthCheckConfig configures the active health checking of the backends of a service
+type HealthCheckConfig struct {
+	// Type is one of "" (disabled), "tcp", "tls" or "http"
+	Type string `toml:"type"`
+	// Port overrides the port probed, by default the TLS port is used for tls checks,
+	// the HTTP port for http checks and the first one defined for tcp checks (TLS, HTTP, TCP then UDP)
+	Port int `toml:"port"`
+	// Path is the path requested by http checks
+	Path string `toml:"path"`
+	// Host is sent as Host header by http checks and as SNI by tls checks
+	Host string `toml:"host"`
+	// Interval between two checks in seconds
+	Interval uint `toml:"interval"`
+	// Timeout of a check in seconds
+	Timeout uint `toml:"timeout"`
+	// Rise is the number of consecutive successful checks to consider a backend up
+	Rise int `toml:"rise"`
+	// Fall is the number of consecutive failed checks to consider a backend down
+	Fall int `toml:"fall"`
+}
+
+func (c HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if c.Interval == 0 {
+		c.Interval = defaultHealthCheckInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultHealthCheckTimeout
+	}
+	if c.Rise <= 0 {
+		c.Rise = defaultHealthCheckRise
+	}
+	if c.Fall <= 0 {
+		c.Fall = defaultHealthCheckFall
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	return c
+}
+
+func (c HealthCheckConfig) validate() error {
+	switch c.Type {
+	case "", HealthCheckTCP, HealthCheckTLS, HealthCheckHTTP:
+		return nil
+	default:
+		return fmt.Errorf("unsupported health check type '%s'", c.Type)
+	}
+}
+
+// addr returns the address probed for backend b
+func (c HealthCheckConfig) addr(b Backend) string {
+	if _, ok := unixSocketPath(b.Addr); ok {
+		return b.Addr
+	}
+	port := c.Port
+	if port == 0 {
+		switch c.Type {
+		case HealthCheckTLS:
+			port = b.TLSPort
+		case HealthCheckHTTP:
+			port = b.HTTPPort
+		default:
+			port = b.TLSPort
+			if port == 0 {
+				port = b.HTTPPort
+			}
+			if port == 0 {
+				port = b.TCPPort
+			}
+			if port == 0 {
+				port = b.UDPPort
+			}
+		}
+	}
+	return net.JoinHostPort(b.Addr, strconv.Itoa(port))
+}
+
+// healthTarget is a backend address probed with a given configuration
+type healthTarget struct {
+	cfg  HealthCheckConfig
+	addr string
+
+	mu        sync.Mutex
+	up        bool
+	successes int
+	failures  int
+	cancel    context.CancelFunc
+}
+
+func (t *healthTarget) key() string {
+	return targetKey(t.cfg, t.addr)
+}
+
+// targetKey identifies the probes of addr with cfg, the targets of services probing the same
+// address with different settings are distinct so each of them gets its own interval and thresholds
+func targetKey(cfg HealthCheckConfig, addr string) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d", cfg.Type, addr, cfg.Host, cfg.Path, cfg.Interval, cfg.Timeout, cfg.Rise, cfg.Fall)
+}
+
+func (t *healthTarget) isUp() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.up
+}
+
+// report records the result of a probe and updates the state of the target
+// according to the rise and fall thresholds
+func (t *healthTarget) report(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		t.failures = 0
+		t.successes++
+		if !t.up && t.successes >= t.cfg.Rise {
+			t.up = true
+			log.Info().Str("backend", t.addr).Str("check", t.cfg.Type).Msg("backend is up")
+		}
+		return
+	}
+
+	t.successes = 0
+	t.failures++
+	if t.up && t.failures >= t.cfg.Fall {
+		t.up = false
+		log.Warn().Err(err).Str("backend", t.addr).Str("check", t.cfg.Type).Msg("backend is down")
+	}
+}
+
+// dial connects to the target, which is either a TCP address or a unix socket
+func (t *healthTarget) dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	if path, ok := unixSocketPath(t.addr); ok {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return dialer.DialContext(ctx, "tcp", t.addr)
+}
+
+func (t *healthTarget) probe() error {
+	timeout := time.Duration(t.cfg.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch t.cfg.Type {
+	case HealthCheckTLS:
+		raw, err := t.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer raw.Close()
+		raw.SetDeadline(time.Now().Add(timeout))
+		conn := tls.Client(raw, &tls.Config{
+			ServerName: t.cfg.Host,
+			// only the ability to complete a handshake is checked
+			InsecureSkipVerify: true,
+		})
+		return conn.Handshake()
+
+	case HealthCheckHTTP:
+		host := t.addr
+		if _, ok := unixSocketPath(t.addr); ok {
+			host = "localhost"
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://"+host+t.cfg.Path, nil)
+		if err != nil {
+			return err
+		}
+		if t.cfg.Host != "" {
+			req.Host = t.cfg.Host
+		}
+		client := http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return t.dial(ctx)
+				},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+
+	default:
+		conn, err := t.dial(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func (t *healthTarget) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(t.cfg.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		t.report(t.probe())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthChecker periodically probes the backends of the services
+// that have a health check configured
+type healthChecker struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	targets map[string]*healthTarget
+	// keys of the targets used by each service
+	services map[string][]string
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		targets:  make(map[string]*healthTarget),
+		services: make(map[string][]string),
+	}
+}
+
+// start starts probing the registered targets until ctx is done
+func (h *healthChecker) start(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ctx = ctx
+	for _, t := range h.targets {
+		h.run(t)
+	}
+}
+
+// must be called with the lock held
+func (h *healthChecker) run(t *healthTarget) {
+	if h.ctx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(h.ctx)
+	t.cancel = cancel
+	go t.run(ctx)
+}
+
+// register sets the list of backends to probe for the service registered under name.
+// Targets that are not used by any service anymore stop being probed
+func (h *healthChecker) register(name string, service Service) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var keys []string
+	if service.HealthCheck.Type != "" {
+		cfg := service.HealthCheck.withDefaults()
+		for _, b := range service.Targets() {
+			t := &healthTarget{cfg: cfg, addr: cfg.addr(b), up: true}
+			key := t.key()
+			keys = append(keys, key)
+			if _, ok := h.targets[key]; ok {
+				continue
+			}
+			h.targets[key] = t
+			h.run(t)
+		}
+	}
+
+	old := h.services[name]
+	if len(keys) == 0 {
+		delete(h.services, name)
+	} else {
+		h.services[name] = keys
+	}
+
+	for _, key := range old {
+		if !h.usedLocked(key) {
+			if t := h.targets[key]; t != nil && t.cancel != nil {
+				t.cancel()
+			}
+			delete(h.targets, key)
+		}
+	}
+}
+
+// allDown reports whether service has direct backends and all of them are down
+func (h *healthChecker) allDown(service Service) bool {
+	if service.ClientSecret != "" || service.HealthCheck.Type == "" {
+		return false
+	}
+	for _, b := range service.Targets() {
+		if h.isUp(service, b) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *healthChecker) usedLocked(key string) bool {
+	for _, keys := range h.services {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUp returns false if backend b of service is known to be down
+func (h *healthChecker) isUp(service Service, b Backend) bool {
+	if service.HealthCheck.Type == "" {
+		return true
+	}
+
+	cfg := service.HealthCheck.withDefaults()
+	h.mu.Lock()
+	t, ok := h.targets[targetKey(cfg, cfg.addr(b))]
+	h.mu.Unlock()
+	if !ok {
+		return true
+	}
+	return t.isUp()
+}
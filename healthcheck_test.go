@@ -0,0 +1,150 @@
+package tcprouter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTargetRiseFall(t *testing.T) {
+	target := &healthTarget{
+		cfg:  HealthCheckConfig{Type: HealthCheckTCP, Rise: 2, Fall: 3},
+		addr: "127.0.0.1:80",
+		up:   true,
+	}
+	failure := errors.New("failure")
+
+	target.report(failure)
+	target.report(failure)
+	assert.Equal(t, target.isUp(), true)
+	target.report(failure)
+	assert.Equal(t, target.isUp(), false)
+
+	target.report(nil)
+	assert.Equal(t, target.isUp(), false)
+	target.report(failure)
+	target.report(nil)
+	target.report(nil)
+	assert.Equal(t, target.isUp(), true)
+}
+
+func TestHealthTargetProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	addr := ts.Listener.Addr().(*net.TCPAddr)
+	backend := Backend{Addr: addr.IP.String(), HTTPPort: addr.Port}
+
+	probe := func(cfg HealthCheckConfig) error {
+		cfg = cfg.withDefaults()
+		target := &healthTarget{cfg: cfg, addr: cfg.addr(backend)}
+		return target.probe()
+	}
+
+	require.NoError(t, probe(HealthCheckConfig{Type: HealthCheckTCP}))
+	require.NoError(t, probe(HealthCheckConfig{Type: HealthCheckHTTP, Path: "/health"}))
+	require.Error(t, probe(HealthCheckConfig{Type: HealthCheckHTTP, Path: "/other"}))
+	require.Error(t, probe(HealthCheckConfig{Type: HealthCheckTLS, Port: addr.Port}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	require.Error(t, probe(HealthCheckConfig{Type: HealthCheckTCP, Port: port, Timeout: 1}))
+}
+
+func TestHealthCheckerRegister(t *testing.T) {
+	h := newHealthChecker()
+	service := Service{
+		Backends:    []Backend{{Addr: "127.0.0.1", HTTPPort: 80}, {Addr: "127.0.0.2", HTTPPort: 80}},
+		HealthCheck: HealthCheckConfig{Type: HealthCheckTCP},
+	}
+
+	h.register("a", service)
+	h.register("b", service)
+	assert.Equal(t, len(h.targets), 2)
+
+	cfg := service.HealthCheck.withDefaults()
+	h.targets[targetKey(cfg, net.JoinHostPort("127.0.0.2", strconv.Itoa(80)))].up = false
+	assert.Equal(t, h.isUp(service, service.Backends[0]), true)
+	assert.Equal(t, h.isUp(service, service.Backends[1]), false)
+
+	h.register("a", Service{})
+	assert.Equal(t, len(h.targets), 2)
+	h.register("b", Service{})
+	assert.Equal(t, len(h.targets), 0)
+}
+
+func TestHealthCheckFallback(t *testing.T) {
+	echo := lineEcho(t)
+	defer echo.Close()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	down := Service{Addr: "127.0.0.1", HTTPPort: closedPort(t), HealthCheck: HealthCheckConfig{Type: HealthCheckTCP}}
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	newServer := func(catchAll Service) *Server {
+		s := NewServer(ServerOptions{}, nil, map[string]Service{
+			"example.com":   down,
+			catchAllService: catchAll,
+		})
+		_, err := s.balancer("example.com", down)
+		require.NoError(t, err)
+		for _, target := range s.health.targets {
+			target.up = false
+		}
+		return s
+	}
+
+	// the backends being down, the connection goes to CATCH_ALL
+	s := newServer(Service{Addr: "127.0.0.1", HTTPPort: echoPort, Limits: ServiceLimits{MaxConnections: 1}})
+	_, conn, release, err := s.connectWithFallback("example.com", down, "example.com", src, backendPort(false))
+	require.NoError(t, err)
+
+	// within the limits of CATCH_ALL
+	_, _, _, err = s.connectWithFallback("example.com", down, "example.com", src, backendPort(false))
+	require.True(t, errors.Is(err, errTooManyConnections))
+	conn.Close()
+	release()
+
+	// and its access lists
+	s = newServer(Service{Addr: "127.0.0.1", HTTPPort: echoPort, Access: AccessConfig{Deny: []string{"10.0.0.0/8"}}})
+	_, _, _, err = s.connectWithFallback("example.com", down, "example.com", src, backendPort(false))
+	require.True(t, errors.Is(err, errAccessDenied))
+
+	// tunnels without a connected client don't fall back
+	s = newServer(Service{Addr: "127.0.0.1", HTTPPort: echoPort})
+	tunnel := Service{ClientSecret: "secret"}
+	_, _, _, err = s.connectWithFallback("tunnel.example.com", tunnel, "tunnel.example.com", src, backendPort(false))
+	require.True(t, errors.Is(err, errNoBackend))
+}
+
+func TestHealthCheckerRegisterChanged(t *testing.T) {
+	h := newHealthChecker()
+	backends := []Backend{{Addr: "127.0.0.1", HTTPPort: 80}}
+	service := Service{Backends: backends, HealthCheck: HealthCheckConfig{Type: HealthCheckTCP, Fall: 3}}
+	other := Service{Backends: backends, HealthCheck: HealthCheckConfig{Type: HealthCheckTCP, Fall: 5}}
+
+	// services probing the same backend with different thresholds get their own target
+	h.register("a", service)
+	h.register("b", other)
+	assert.Equal(t, len(h.targets), 2)
+
+	// a changed configuration replaces the target of the service
+	h.register("b", Service{})
+	service.HealthCheck.Interval = 30
+	h.register("a", service)
+	assert.Equal(t, len(h.targets), 1)
+	for _, target := range h.targets {
+		assert.Equal(t, target.cfg.Interval, uint(30))
+		assert.Equal(t, target.cfg.Fall, 3)
+	}
+}
@@ -0,0 +1,59 @@
+package tcprouter
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// catchAllService is the name of the service used when no other service matches
+const catchAllService = "CATCH_ALL"
+
+// normalizeHost returns the canonical form of a host name used to index services:
+// lower case, ASCII (punycode) encoded and without trailing dot
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+	if host == catchAllService {
+		return host
+	}
+
+	wildcard := strings.HasPrefix(host, "*.")
+	if wildcard {
+		host = host[2:]
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	if wildcard {
+		host = "*." + host
+	}
+
+	return strings.ToLower(host)
+}
+
+// hostCandidates returns the list of names a service can be registered under
+// to match host, from the most to the least specific one.
+// For "a.b.example.com" it returns
+// "a.b.example.com", "*.b.example.com", "*.example.com" and "*.com"
+func hostCandidates(host string) []string {
+	candidates := []string{host}
+	if host == "" {
+		return candidates
+	}
+
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels); i++ {
+		candidates = append(candidates, "*."+strings.Join(labels[i:], "."))
+	}
+
+	return candidates
+}
+
+// normalizeServices returns a copy of services with all the keys normalized
+func normalizeServices(services map[string]Service) map[string]Service {
+	normalized := make(map[string]Service, len(services))
+	for name, service := range services {
+		normalized[normalizeHost(name)] = service
+	}
+	return normalized
+}
@@ -0,0 +1,48 @@
+package tcprouter
+
+import (
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM":        "example.com",
+		"example.com.":       "example.com",
+		"bücher.example.com": "xn--bcher-kva.example.com",
+		"*.Bücher.de":        "*.xn--bcher-kva.de",
+		"CATCH_ALL":          "CATCH_ALL",
+		"":                   "",
+	}
+	for host, expected := range tests {
+		assert.Equal(t, normalizeHost(host), expected, host)
+	}
+}
+
+func TestLookupService(t *testing.T) {
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"www.example.com":      {Addr: "exact"},
+		"*.example.com":        {Addr: "wildcard"},
+		"*.tenant.example.com": {Addr: "tenant"},
+	})
+
+	tests := map[string]string{
+		"www.example.com":      "exact",
+		"foo.example.com":      "wildcard",
+		"a.b.example.com":      "wildcard",
+		"a.tenant.example.com": "tenant",
+		"example.com":          "",
+		"example.org":          "",
+	}
+	for host, expected := range tests {
+		_, service, _ := s.lookupService(host)
+		assert.Equal(t, service.Addr, expected, host)
+	}
+
+	s.Services[catchAllService] = Service{Addr: "catch all"}
+	name, service, ok := s.lookupService("example.org")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, name, catchAllService)
+	assert.Equal(t, service.Addr, "catch all")
+}
@@ -0,0 +1,546 @@
+package tcprouter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Modes of the HTTP listener
+const (
+	// HTTPModeConnection routes a connection on its first request then forwards it as is
+	HTTPModeConnection = "connection"
+	// HTTPModeRequest routes each request of a keep-alive connection independently
+	HTTPModeRequest = "request"
+)
+
+const (
+	defaultMaxHeaderBytes   = 1 << 20
+	defaultKeepAliveTimeout = 60
+)
+
+// HTTPConfig configures how the HTTP listener parses and routes requests
+type HTTPConfig struct {
+	// Mode is one of "connection" (default) or "request"
+	Mode string `toml:"mode"`
+	// MaxHeaderBytes is the maximum size of the request line and headers of a request
+	MaxHeaderBytes int `toml:"maxheaderbytes"`
+	// KeepAliveTimeout is the number of seconds to wait for the next request
+	// of a keep-alive connection in request mode
+	KeepAliveTimeout uint `toml:"keepalivetimeout"`
+	// HTTPSRedirect is the status code (301 or 308) used to redirect the requests
+	// to https for the services that don't set their own. 0 disables it
+	HTTPSRedirect int `toml:"httpsredirect"`
+}
+
+func (c HTTPConfig) validate() error {
+	switch c.Mode {
+	case "", HTTPModeConnection, HTTPModeRequest:
+	default:
+		return fmt.Errorf("unsupported http mode '%s'", c.Mode)
+	}
+	switch c.HTTPSRedirect {
+	case 0, http.StatusMovedPermanently, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("unsupported httpsredirect status %d", c.HTTPSRedirect)
+	}
+	return nil
+}
+
+func (c HTTPConfig) maxHeaderBytes() int64 {
+	if c.MaxHeaderBytes <= 0 {
+		return defaultMaxHeaderBytes
+	}
+	return int64(c.MaxHeaderBytes)
+}
+
+func (c HTTPConfig) keepAliveTimeout() time.Duration {
+	if c.KeepAliveTimeout == 0 {
+		return defaultKeepAliveTimeout * time.Second
+	}
+	return time.Duration(c.KeepAliveTimeout) * time.Second
+}
+
+var errHeaderTooLarge = errors.New("request header too large")
+
+// headerReader limits the number of bytes read while parsing the headers of a request
+// and records the bytes read from the connection until stopRecording is called
+type headerReader struct {
+	r         io.Reader
+	remaining int64
+	limited   bool
+	record    bool
+	recorded  bytes.Buffer
+}
+
+// limit limits the next reads to n bytes
+func (h *headerReader) limit(n int64) {
+	h.remaining, h.limited = n, true
+}
+
+// unlimit removes the limit, e.g. to read the body of a request
+func (h *headerReader) unlimit() {
+	h.limited = false
+}
+
+func (h *headerReader) stopRecording() {
+	h.record = false
+	h.recorded = bytes.Buffer{}
+}
+
+func (h *headerReader) Read(p []byte) (int, error) {
+	if h.limited {
+		if h.remaining <= 0 {
+			return 0, errHeaderTooLarge
+		}
+		if int64(len(p)) > h.remaining {
+			p = p[:h.remaining]
+		}
+	}
+	n, err := h.r.Read(p)
+	if h.limited {
+		h.remaining -= int64(n)
+	}
+	if h.record {
+		h.recorded.Write(p[:n])
+	}
+	return n, err
+}
+
+// readRequest reads the next request from br, hr being the reader below br
+func readRequest(br *bufio.Reader, hr *headerReader, max int64) (*http.Request, error) {
+	// bytes already buffered by a previous request count in the limit
+	hr.limit(max - int64(br.Buffered()))
+	defer hr.unlimit()
+	return http.ReadRequest(br)
+}
+
+// requestHost returns the host of req without port, IPv6 literals without brackets
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	// no port, only IPv6 literals are bracketed
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// writeHTTPError sends a minimal error response on conn
+func writeHTTPError(conn io.Writer, status int) {
+	body := http.StatusText(status) + "\n"
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+}
+
+func (s *Server) handleHTTPConnection(conn WriteCloser) {
+	cfg := s.ServerOptions.HTTP
+	hr := &headerReader{r: conn, record: cfg.Mode != HTTPModeRequest}
+	br := bufio.NewReader(hr)
+
+	conn.SetReadDeadline(time.Now().Add(s.ServerOptions.Timeouts.sniff()))
+	req, err := readRequest(br, hr, cfg.maxHeaderBytes())
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to decode HTTP header")
+		var netErr net.Error
+		if errors.Is(err, errHeaderTooLarge) {
+			writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge)
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
+			writeHTTPError(conn, http.StatusRequestTimeout)
+		} else if err != io.EOF {
+			writeHTTPError(conn, http.StatusBadRequest)
+		}
+		conn.Close()
+		return
+	}
+
+	host := requestHost(req)
+	if host == "" {
+		log.Error().Msg("could not find host in HTTP header")
+		writeHTTPError(conn, http.StatusBadRequest)
+		conn.Close()
+		return
+	}
+	log.Info().Msgf("Host found: '%s'", host)
+
+	if s.isACMEChallenge(req) {
+		if err := s.serveACMEChallenge(conn, req); err != nil {
+			log.Error().Err(err).Str("server name", host).Msg("failed to answer acme challenge")
+		}
+		return
+	}
+
+	if cfg.Mode == HTTPModeRequest {
+		s.serveRequests(conn, br, hr, req)
+		return
+	}
+
+	if s.denyHost(conn, host) {
+		return
+	}
+	if status := s.httpsRedirect(host); status != 0 {
+		if err := s.redirectToHTTPS(conn, req, status, false); err != nil {
+			log.Error().Err(err).Str("server name", host).Msg("failed to redirect to https")
+		}
+		conn.Close()
+		return
+	}
+
+	// all the bytes read from the connection, including the ones buffered past the
+	// first request, are replayed to the backend
+	peeked := hr.recorded.String()
+	hr.stopRecording()
+	if err := s.handleService(conn, host, peeked, false, nil); err != nil {
+		log.Error().
+			Str("server name", host).
+			Err(err).
+			Msg("error forwarding traffic")
+	}
+}
+
+// httpUpstream is the connection to the service serving the requests for host
+type httpUpstream struct {
+	host     string
+	conn     WriteCloser
+	br       *bufio.Reader
+	timeouts connTimeouts
+	release  func()
+
+	watchdog *watchdog
+	unwatch  func()
+}
+
+// watch enforces the timeouts of the service on the connection of the client, read through hr,
+// and on the upstream for as long as they exchange requests. The lifetime of the client
+// connection started at since
+func (u *httpUpstream) watch(conn WriteCloser, hr *headerReader, since time.Time) {
+	timeouts := u.timeouts
+	if timeouts.lifetime > 0 {
+		timeouts.lifetime -= time.Since(since)
+		if timeouts.lifetime <= 0 {
+			// expire right away
+			timeouts.lifetime = time.Nanosecond
+		}
+	}
+	local, remote, w := timeouts.watch(conn, u.conn)
+	u.watchdog = w
+	// nothing has been read from the upstream yet
+	u.br = bufio.NewReader(remote)
+	hr.r = local
+	u.unwatch = func() { hr.r = conn }
+}
+
+// stopWatching stops enforcing the timeouts, e.g. before the connections are handed over
+func (u *httpUpstream) stopWatching() {
+	u.watchdog.stop()
+	if u.unwatch != nil {
+		u.unwatch()
+	}
+}
+
+func (u *httpUpstream) close() {
+	u.stopWatching()
+	u.conn.Close()
+	u.release()
+}
+
+func (s *Server) dialHTTPUpstream(incoming WriteCloser, host string) (*httpUpstream, int, error) {
+	serverName := normalizeHost(host)
+	name, service, exists := s.lookupService(serverName)
+	if !exists {
+		return nil, http.StatusNotFound, fmt.Errorf("service doesn't exist: %s and no '%s' service for request", serverName, catchAllService)
+	}
+	if err := s.checkAccess(service, incoming.RemoteAddr()); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	limited, err := s.limiter.acquireService(name, service.Limits)
+	if err != nil {
+		return nil, rejectStatus(err), err
+	}
+
+	service, outgoing, release, err := s.connectWithFallback(name, service, serverName, incoming.RemoteAddr(), backendPort(false))
+	if err != nil {
+		limited()
+		switch {
+		case errors.Is(err, errAccessDenied):
+			return nil, http.StatusForbidden, err
+		case errors.Is(err, errRateLimited), errors.Is(err, errTooManyConnections):
+			return nil, rejectStatus(err), err
+		}
+		return nil, http.StatusBadGateway, err
+	}
+	if err := sendProxyHeader(incoming, outgoing, service, serverName); err != nil {
+		outgoing.Close()
+		release()
+		limited()
+		return nil, http.StatusBadGateway, err
+	}
+
+	return &httpUpstream{
+		host:     serverName,
+		conn:     outgoing,
+		br:       bufio.NewReader(outgoing),
+		timeouts: s.timeouts(service),
+		release: func() {
+			release()
+			limited()
+		},
+	}, 0, nil
+}
+
+// serveRequests routes each request read from conn to the service of its host.
+// The connection to a service is kept while consecutive requests are for the same host
+func (s *Server) serveRequests(conn WriteCloser, br *bufio.Reader, hr *headerReader, req *http.Request) {
+	cfg := s.ServerOptions.HTTP
+	started := time.Now()
+
+	var upstream *httpUpstream
+	defer func() {
+		if upstream != nil {
+			upstream.close()
+		}
+	}()
+
+	for {
+		host := normalizeHost(requestHost(req))
+		if upstream != nil && upstream.host != host {
+			upstream.close()
+			upstream = nil
+		}
+
+		switch {
+		case host == "":
+			log.Error().Msg("could not find host in HTTP header")
+			writeHTTPError(conn, http.StatusBadRequest)
+			conn.Close()
+			return
+		case s.isACMEChallenge(req):
+			if err := s.serveACMEChallenge(conn, req); err != nil {
+				log.Error().Err(err).Str("server name", host).Msg("failed to answer acme challenge")
+			}
+			return
+		}
+
+		keepAlive := !req.Close
+		if status := s.httpsRedirect(host); status != 0 {
+			// denied sources get the same answer as in connection mode
+			if s.denyHost(conn, host) {
+				return
+			}
+			if err := s.redirectToHTTPS(conn, req, status, keepAlive); err != nil {
+				log.Error().Err(err).Str("server name", host).Msg("failed to redirect to https")
+				keepAlive = false
+			}
+		} else {
+			if upstream == nil {
+				var (
+					status int
+					err    error
+				)
+				upstream, status, err = s.dialHTTPUpstream(conn, host)
+				if errors.Is(err, errRateLimited) || errors.Is(err, errTooManyConnections) {
+					s.reject(conn, trafficHTTP, err)
+					return
+				}
+				if err != nil {
+					log.Error().Str("server name", host).Err(err).Msg("error forwarding traffic")
+					writeHTTPError(conn, status)
+					conn.Close()
+					return
+				}
+				upstream.watch(conn, hr, started)
+			}
+
+			log.Debug().
+				Str("server name", host).
+				Str("method", req.Method).
+				Str("path", req.URL.Path).
+				Msg("forward request")
+
+			var (
+				reusable, upgraded bool
+				err                error
+			)
+			keepAlive, reusable, upgraded, err = roundTrip(conn, upstream, req)
+			if err != nil {
+				if !upstream.watchdog.hasExpired() {
+					log.Error().Str("server name", host).Err(err).Msg("error forwarding request")
+				}
+				conn.Close()
+				return
+			}
+			if upgraded {
+				// the connection now speaks another protocol, e.g. websocket
+				upstream.stopWatching()
+				incoming := GetConn(conn, getPeeked(br))
+				outgoing := GetConn(upstream.conn, getPeeked(upstream.br))
+				release, timeouts := upstream.release, upstream.timeouts
+				upstream = nil
+				defer release()
+				forwardConnection(incoming, outgoing, timeouts)
+				return
+			}
+			if !reusable {
+				upstream.close()
+				upstream = nil
+			}
+		}
+		if !keepAlive || s.isShuttingDown() {
+			conn.Close()
+			return
+		}
+
+		// idle connections are closed as soon as the server shuts down
+		deadline := time.Now().Add(cfg.keepAliveTimeout())
+		conn.SetReadDeadline(deadline)
+		stop := s.onShutdown(func() { conn.SetReadDeadline(time.Now()) })
+		_, err := br.Peek(1)
+		stop()
+		if err == nil {
+			conn.SetReadDeadline(deadline)
+			req, err = readRequest(br, hr, cfg.maxHeaderBytes())
+		}
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if errors.Is(err, errHeaderTooLarge) {
+				writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge)
+			} else if err != io.EOF {
+				log.Debug().Err(err).Msg("failed to read next request")
+			}
+			conn.Close()
+			return
+		}
+	}
+}
+
+// httpsRedirect returns the status code used to redirect the requests for host
+// to https, 0 if they must be forwarded
+func (s *Server) httpsRedirect(host string) int {
+	_, service, ok := s.lookupService(normalizeHost(host))
+	if !ok {
+		return 0
+	}
+	switch service.HTTPSRedirect {
+	case -1:
+		return 0
+	case 0:
+		return s.ServerOptions.HTTP.HTTPSRedirect
+	default:
+		return service.HTTPSRedirect
+	}
+}
+
+// denyHost answers with a 403 and closes conn if its source can't reach the service of host
+func (s *Server) denyHost(conn WriteCloser, host string) bool {
+	_, service, ok := s.lookupService(normalizeHost(host))
+	if !ok {
+		return false
+	}
+	if err := s.checkAccess(service, conn.RemoteAddr()); err != nil {
+		logAccessDenied(err, host, conn.RemoteAddr())
+		writeHTTPError(conn, http.StatusForbidden)
+		conn.Close()
+		return true
+	}
+	return false
+}
+
+// redirectToHTTPS answers req with a redirection to the https equivalent of its URL
+func (s *Server) redirectToHTTPS(conn WriteCloser, req *http.Request, status int, keepAlive bool) error {
+	// the body of the request must be consumed before the next request can be read
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		return err
+	}
+
+	host := requestHost(req)
+	if port := s.options().ListeningTLSPort; port != 0 && port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	} else if strings.Contains(host, ":") {
+		// IPv6 literal
+		host = "[" + host + "]"
+	}
+	location := "https://" + host + req.URL.RequestURI()
+
+	log.Info().
+		Str("server name", req.Host).
+		Str("location", location).
+		Int("status", status).
+		Msg("redirect to https")
+
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Location": []string{location}},
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Close:         !keepAlive,
+	}
+	return resp.Write(conn)
+}
+
+// roundTrip sends req to upstream and its response back to conn. It returns whether
+// the client connection can be used for another request, whether the upstream connection
+// can be reused and whether the connection got upgraded to another protocol
+func roundTrip(conn WriteCloser, upstream *httpUpstream, req *http.Request) (keepAlive, reusable, upgraded bool, err error) {
+	// the body is only sent by the client once it got the interim response,
+	// which is answered here so the request can be forwarded in a single pass
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Header.Del("Expect")
+		if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return false, false, false, err
+		}
+	}
+	// prevent Request.Write from adding its own User-Agent
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = nil
+	}
+
+	if err := req.Write(upstream.conn); err != nil {
+		return false, false, false, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	var resp *http.Response
+	for {
+		resp, err = http.ReadResponse(upstream.br, req)
+		if err != nil {
+			return false, false, false, fmt.Errorf("failed to read response: %w", err)
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		// other interim responses are relayed as is
+		if err := resp.Write(conn); err != nil {
+			return false, false, false, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return false, false, true, resp.Write(conn)
+	}
+
+	// a body delimited by the end of the connection can't be followed by another response
+	closeDelimited := resp.ContentLength == -1 && resp.Body != http.NoBody &&
+		!(len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked")
+	keepAlive = !req.Close && !closeDelimited
+	reusable = !resp.Close && !closeDelimited
+	// the connection to the client is managed independently of the one to the backend
+	resp.Header.Del("Connection")
+	resp.Close = !keepAlive
+
+	if err := resp.Write(conn); err != nil {
+		return false, false, false, err
+	}
+	return keepAlive, reusable, false, nil
+}
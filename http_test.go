@@ -0,0 +1,263 @@
+package tcprouter
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// httpBackend starts an HTTP server answering with its name and the request body
+func httpBackend(t *testing.T, name string) (*httptest.Server, int) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", name, r.URL.Path, body)
+	}))
+	return srv, srv.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// serveHTTP starts the HTTP listener of s
+func serveHTTP(t *testing.T, s *Server) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleHTTPConnection(conn.(*net.TCPConn))
+		}
+	}()
+	return l
+}
+
+func TestHTTPRequestMode(t *testing.T) {
+	a, aPort := httpBackend(t, "a")
+	defer a.Close()
+	b, bPort := httpBackend(t, "b")
+	defer b.Close()
+
+	s := NewServer(ServerOptions{HTTP: HTTPConfig{Mode: HTTPModeRequest, MaxHeaderBytes: 4096}}, nil, map[string]Service{
+		"a.com": {Addr: "127.0.0.1", HTTPPort: aPort},
+		"b.com": {Addr: "127.0.0.1", HTTPPort: bPort},
+	})
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	do := func(req string) (int, string) {
+		_, err := conn.Write([]byte(req))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := do("GET /first HTTP/1.1\r\nHost: a.com\r\n\r\n")
+	assert.Equal(t, body, "a /first ")
+	_, body = do("POST /second HTTP/1.1\r\nhost: B.com:80\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Equal(t, body, "b /second hello")
+	_, body = do("GET /third HTTP/1.1\r\nHOST: a.com\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n")
+	assert.Equal(t, body, "a /third hi")
+	status, _ := do("GET / HTTP/1.1\r\nHost: unknown.com\r\n\r\n")
+	assert.Equal(t, status, http.StatusNotFound)
+}
+
+func TestHTTPHeaderLimit(t *testing.T) {
+	s := NewServer(ServerOptions{HTTP: HTTPConfig{MaxHeaderBytes: 1024}}, nil, nil)
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\nX-Big: " + strings.Repeat("a", 2048) + "\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+}
+
+func TestHTTPConnectionMode(t *testing.T) {
+	a, aPort := httpBackend(t, "a")
+	defer a.Close()
+
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"a.com": {Addr: "127.0.0.1", HTTPPort: aPort},
+	})
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the whole connection goes to the backend of the first request
+	_, err = conn.Write([]byte("POST /x HTTP/1.1\r\nhost: a.com\r\nContent-Length: 3\r\n\r\nabcGET /y HTTP/1.1\r\nHost: b.com\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for _, expected := range []string{"a /x abc", "a /y "} {
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, string(body), expected)
+	}
+}
+
+func TestHTTPRequestUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		conn.Write([]byte(line))
+	}))
+	defer srv.Close()
+
+	s := NewServer(ServerOptions{HTTP: HTTPConfig{Mode: HTTPModeRequest}}, nil, map[string]Service{
+		"a.com": {Addr: "127.0.0.1", HTTPPort: srv.Listener.Addr().(*net.TCPAddr).Port},
+	})
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusSwitchingProtocols)
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	b, bPort := httpBackend(t, "b")
+	defer b.Close()
+
+	kv := newMemStore()
+	s := NewServer(ServerOptions{
+		ListeningTLSPort: 8443,
+		HTTP:             HTTPConfig{Mode: HTTPModeRequest, HTTPSRedirect: http.StatusPermanentRedirect},
+	}, kv, map[string]Service{
+		"a.com": {Addr: "127.0.0.1", TerminateTLS: true, ACME: true},
+		"b.com": {Addr: "127.0.0.1", HTTPPort: bPort, HTTPSRedirect: -1},
+		"c.com": {Addr: "127.0.0.1", HTTPSRedirect: http.StatusMovedPermanently},
+		"::1":   {Addr: "127.0.0.1"},
+	})
+	var err error
+	s.acme, err = s.newACMEManager(ACMEConfig{Directory: "http://127.0.0.1:1/directory"})
+	require.NoError(t, err)
+	require.NoError(t, acmeCache{kv: kv}.Put(nil, "token+http-01", []byte("token.thumbprint")))
+
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	do := func(req string) *http.Response {
+		_, err := conn.Write([]byte(req))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("GET /path?q=1 HTTP/1.1\r\nHost: a.com\r\n\r\n")
+	assert.Equal(t, resp.StatusCode, http.StatusPermanentRedirect)
+	assert.Equal(t, resp.Header.Get("Location"), "https://a.com:8443/path?q=1")
+
+	resp = do("GET /path HTTP/1.1\r\nHost: [::1]\r\n\r\n")
+	assert.Equal(t, resp.StatusCode, http.StatusPermanentRedirect)
+	assert.Equal(t, resp.Header.Get("Location"), "https://[::1]:8443/path")
+
+	resp = do("POST /form HTTP/1.1\r\nHost: c.com\r\nContent-Length: 4\r\n\r\ndata")
+	assert.Equal(t, resp.StatusCode, http.StatusMovedPermanently)
+	assert.Equal(t, resp.Header.Get("Location"), "https://c.com:8443/form")
+
+	// the connection is still usable for services that are not redirected
+	resp = do("GET /b HTTP/1.1\r\nHost: b.com\r\n\r\n")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	// acme challenges are answered instead of redirected
+	resp = do("GET /.well-known/acme-challenge/token HTTP/1.1\r\nHost: a.com\r\n\r\n")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+}
+
+func TestHTTPSRedirectConnectionMode(t *testing.T) {
+	s := NewServer(ServerOptions{HTTP: HTTPConfig{HTTPSRedirect: http.StatusMovedPermanently}}, nil, map[string]Service{
+		"a.com":         {Addr: "127.0.0.1"},
+		catchAllService: {Addr: "127.0.0.1"},
+	})
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	for host, location := range map[string]string{
+		"a.com":      "https://a.com/path",
+		"[::1]":      "https://[::1]/path",
+		"[::1]:8080": "https://[::1]/path",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET /path HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusMovedPermanently)
+		assert.Equal(t, resp.Header.Get("Location"), location)
+	}
+}
+
+func TestHTTPSRedirectAccessDenied(t *testing.T) {
+	for _, mode := range []string{HTTPModeConnection, HTTPModeRequest} {
+		s := NewServer(ServerOptions{HTTP: HTTPConfig{Mode: mode}}, nil, map[string]Service{
+			"a.com": {Addr: "127.0.0.1", HTTPSRedirect: http.StatusMovedPermanently, Access: AccessConfig{Deny: []string{"127.0.0.0/8"}}},
+		})
+		l := serveHTTP(t, s)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		conn.Close()
+		l.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,340 @@
+package tcprouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Behaviors when a connection is rejected by a limit
+const (
+	// RejectClose closes the connection
+	RejectClose = "close"
+	// RejectReset aborts the connection with a TCP reset
+	RejectReset = "reset"
+	// RejectRespond answers with a protocol error before closing: a 429 or 503 status
+	// for HTTP requests and an internal_error alert for TLS handshakes
+	RejectRespond = "respond"
+)
+
+// buckets of the sources that didn't connect for this long are forgotten
+const limiterSweepInterval = time.Minute
+
+// LimitsConfig protects the router against sources and services using too many connections
+type LimitsConfig struct {
+	// MaxConnections is the maximum number of concurrent connections accepted by the router
+	MaxConnections int `toml:"maxconnections"`
+	// MaxConnectionsPerIP is the maximum number of concurrent connections of a source address
+	MaxConnectionsPerIP int `toml:"maxconnectionsperip"`
+	// RatePerIP is the number of new connections per second allowed for a source address
+	RatePerIP float64 `toml:"rateperip"`
+	// BurstPerIP is the number of new connections a source address can open at once, default to RatePerIP
+	BurstPerIP int `toml:"burstperip"`
+	// Reject is the behavior for rejected connections: close (default), reset or respond
+	Reject string `toml:"reject"`
+}
+
+func (c LimitsConfig) validate() error {
+	if c.MaxConnections < 0 || c.MaxConnectionsPerIP < 0 || c.RatePerIP < 0 || c.BurstPerIP < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	switch c.Reject {
+	case "", RejectClose, RejectReset, RejectRespond:
+	default:
+		return fmt.Errorf("unknown reject behavior '%s'", c.Reject)
+	}
+	return nil
+}
+
+// ServiceLimits limits the connections to a service
+type ServiceLimits struct {
+	// MaxConnections is the maximum number of concurrent connections to the service
+	MaxConnections int `toml:"maxconnections"`
+	// Rate is the number of new connections per second allowed to the service
+	Rate float64 `toml:"rate"`
+	// Burst is the number of new connections accepted at once, default to Rate
+	Burst int `toml:"burst"`
+}
+
+func (l ServiceLimits) validate() error {
+	if l.MaxConnections < 0 || l.Rate < 0 || l.Burst < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	return nil
+}
+
+var (
+	// errRateLimited is returned when a connection exceeds a rate limit
+	errRateLimited = errors.New("rate limited")
+	// errTooManyConnections is returned when a connection exceeds a concurrency limit
+	errTooManyConnections = errors.New("too many connections")
+)
+
+// tokenBucket allows rate events per second with bursts of up to burst events
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// allow takes a token from the bucket if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full returns true if the bucket refilled completely, it can then be forgotten
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// limiter counts the active connections and keeps the token buckets of the sources and services
+type limiter struct {
+	now func() time.Time
+
+	mu             sync.Mutex
+	total          int
+	perIP          map[string]int
+	ipBuckets      map[string]*tokenBucket
+	services       map[string]int
+	serviceBuckets map[string]*tokenBucket
+	lastSweep      time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		now:            time.Now,
+		perIP:          make(map[string]int),
+		ipBuckets:      make(map[string]*tokenBucket),
+		services:       make(map[string]int),
+		serviceBuckets: make(map[string]*tokenBucket),
+	}
+}
+
+// bucket returns the bucket stored under key in buckets, a new one is created
+// when there is none or when the limits changed
+func bucket(buckets map[string]*tokenBucket, key string, rate float64, burst int, now time.Time) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok || b.rate != rate || b.burst != newTokenBucket(rate, burst, now).burst {
+		b = newTokenBucket(rate, burst, now)
+		buckets[key] = b
+	}
+	return b
+}
+
+// sweep forgets the buckets that refilled completely. Must be called with mu held
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for _, buckets := range []map[string]*tokenBucket{l.ipBuckets, l.serviceBuckets} {
+		for key, b := range buckets {
+			if b.full(now) {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// acquireConnection accounts for a new connection from src. The returned function
+// must be called once the connection is closed
+func (l *limiter) acquireConnection(cfg LimitsConfig, src net.Addr) (func(), error) {
+	ip := ""
+	if addr := sourceIP(src); addr != nil {
+		ip = addr.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	if cfg.MaxConnections > 0 && l.total >= cfg.MaxConnections {
+		return nil, fmt.Errorf("%w: router reached its limit of %d connections", errTooManyConnections, cfg.MaxConnections)
+	}
+	if ip != "" {
+		if cfg.MaxConnectionsPerIP > 0 && l.perIP[ip] >= cfg.MaxConnectionsPerIP {
+			return nil, fmt.Errorf("%w: source %s reached its limit of %d connections", errTooManyConnections, ip, cfg.MaxConnectionsPerIP)
+		}
+		if cfg.RatePerIP > 0 && !bucket(l.ipBuckets, ip, cfg.RatePerIP, cfg.BurstPerIP, now).allow(now) {
+			return nil, fmt.Errorf("%w: source %s exceeded %g connections per second", errRateLimited, ip, cfg.RatePerIP)
+		}
+	}
+
+	l.total++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if ip == "" {
+				return
+			}
+			if l.perIP[ip]--; l.perIP[ip] <= 0 {
+				delete(l.perIP, ip)
+			}
+		})
+	}, nil
+}
+
+// acquireService accounts for a new connection to the service registered under name.
+// The returned function must be called once the connection is closed
+func (l *limiter) acquireService(name string, limits ServiceLimits) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	if limits.MaxConnections > 0 && l.services[name] >= limits.MaxConnections {
+		return nil, fmt.Errorf("%w: service %s reached its limit of %d connections", errTooManyConnections, name, limits.MaxConnections)
+	}
+	if limits.Rate > 0 && !bucket(l.serviceBuckets, name, limits.Rate, limits.Burst, now).allow(now) {
+		return nil, fmt.Errorf("%w: service %s exceeded %g connections per second", errRateLimited, name, limits.Rate)
+	}
+
+	l.services[name]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.services[name]--; l.services[name] <= 0 {
+				delete(l.services, name)
+			}
+		})
+	}, nil
+}
+
+// Kinds of traffic, they decide how rejected connections are answered
+type trafficKind int
+
+const (
+	trafficTCP trafficKind = iota
+	trafficTLS
+	trafficHTTP
+)
+
+// trafficKindOf guesses the kind of traffic from the first bytes received
+func trafficKindOf(isTLS bool, peeked string) trafficKind {
+	if isTLS {
+		return trafficTLS
+	}
+	line := peeked
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if strings.Contains(line, " HTTP/1.") {
+		return trafficHTTP
+	}
+	return trafficTCP
+}
+
+// tlsInternalErrorAlert is a fatal TLS alert record with the internal_error description
+var tlsInternalErrorAlert = []byte{
+	0x15,       // content type: alert
+	0x03, 0x03, // version
+	0x00, 0x02, // length
+	0x02, // level: fatal
+	0x50, // description: internal_error (80)
+}
+
+// rejectStatus is the HTTP status answered for a connection rejected because of err
+func rejectStatus(err error) int {
+	if errors.Is(err, errRateLimited) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+// linger is implemented by TCP connections
+type linger interface {
+	SetLinger(sec int) error
+}
+
+// underlyingConn returns the connection wrapped by the connection proxies of the router
+func underlyingConn(conn WriteCloser) WriteCloser {
+	for {
+		switch c := conn.(type) {
+		case *Conn:
+			conn = c.WriteCloser
+		case *proxiedConn:
+			conn = c.WriteCloser
+		default:
+			return conn
+		}
+	}
+}
+
+// reject logs why conn has been rejected and closes it the way configured
+func (s *Server) reject(conn WriteCloser, kind trafficKind, err error) {
+	log.Warn().
+		Err(err).
+		Str("remote addr", conn.RemoteAddr().String()).
+		Msg("connection rejected")
+
+	switch s.ServerOptions.Limits.Reject {
+	case RejectReset:
+		if c, ok := underlyingConn(conn).(linger); ok {
+			c.SetLinger(0)
+		}
+	case RejectRespond:
+		switch kind {
+		case trafficTLS:
+			conn.Write(tlsInternalErrorAlert)
+		case trafficHTTP:
+			writeHTTPError(conn, rejectStatus(err))
+		}
+	}
+	conn.Close()
+}
+
+// limitConnections wraps handler to enforce the limits of the router on the connections
+// accepted by a listener receiving traffic of the given kind
+func (s *Server) limitConnections(kind trafficKind, handler Handler) Handler {
+	return HandlerFunc(func(conn WriteCloser) {
+		release, err := s.limiter.acquireConnection(s.ServerOptions.Limits, conn.RemoteAddr())
+		if err != nil {
+			s.reject(conn, kind, err)
+			return
+		}
+		defer release()
+		handler.ServeTCP(conn)
+	})
+}
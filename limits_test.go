@@ -0,0 +1,112 @@
+package tcprouter
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, b.allow(now), true)
+	}
+	assert.Equal(t, b.allow(now), false)
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, b.allow(now), true)
+	assert.Equal(t, b.allow(now), false)
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, b.full(now), true)
+}
+
+func TestLimiterConnections(t *testing.T) {
+	l := newLimiter()
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	cfg := LimitsConfig{MaxConnections: 3, MaxConnectionsPerIP: 2, RatePerIP: 1, BurstPerIP: 10}
+	src := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	a1, err := l.acquireConnection(cfg, src("192.0.2.1"))
+	require.NoError(t, err)
+	_, err = l.acquireConnection(cfg, src("192.0.2.1"))
+	require.NoError(t, err)
+	_, err = l.acquireConnection(cfg, src("192.0.2.1"))
+	assert.Equal(t, errors.Is(err, errTooManyConnections), true)
+
+	_, err = l.acquireConnection(cfg, src("192.0.2.2"))
+	require.NoError(t, err)
+	_, err = l.acquireConnection(cfg, src("192.0.2.3"))
+	assert.Equal(t, errors.Is(err, errTooManyConnections), true)
+
+	// releasing twice only frees one slot
+	a1()
+	a1()
+	_, err = l.acquireConnection(cfg, src("192.0.2.3"))
+	require.NoError(t, err)
+	_, err = l.acquireConnection(cfg, src("192.0.2.3"))
+	assert.Equal(t, errors.Is(err, errTooManyConnections), true)
+
+	cfg = LimitsConfig{RatePerIP: 1, BurstPerIP: 1}
+	_, err = l.acquireConnection(cfg, src("198.51.100.1"))
+	require.NoError(t, err)
+	_, err = l.acquireConnection(cfg, src("198.51.100.1"))
+	assert.Equal(t, errors.Is(err, errRateLimited), true)
+	now = now.Add(time.Second)
+	_, err = l.acquireConnection(cfg, src("198.51.100.1"))
+	require.NoError(t, err)
+}
+
+func TestLimiterService(t *testing.T) {
+	l := newLimiter()
+	release, err := l.acquireService("a.com", ServiceLimits{MaxConnections: 1})
+	require.NoError(t, err)
+	_, err = l.acquireService("a.com", ServiceLimits{MaxConnections: 1})
+	assert.Equal(t, errors.Is(err, errTooManyConnections), true)
+	_, err = l.acquireService("b.com", ServiceLimits{MaxConnections: 1})
+	require.NoError(t, err)
+	release()
+	_, err = l.acquireService("a.com", ServiceLimits{MaxConnections: 1})
+	require.NoError(t, err)
+}
+
+func TestServiceRateLimitHTTP(t *testing.T) {
+	for _, mode := range []string{HTTPModeConnection, HTTPModeRequest} {
+		a, aPort := httpBackend(t, "a")
+		defer a.Close()
+
+		s := NewServer(ServerOptions{
+			HTTP:   HTTPConfig{Mode: mode},
+			Limits: LimitsConfig{Reject: RejectRespond},
+		}, nil, map[string]Service{
+			"a.com": {Addr: "127.0.0.1", HTTPPort: aPort, Limits: ServiceLimits{Rate: 0.001, Burst: 1}},
+		})
+		l := serveHTTP(t, s)
+		defer l.Close()
+
+		get := func() int {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n"))
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, get(), http.StatusOK, mode)
+		assert.Equal(t, get(), http.StatusTooManyRequests, mode)
+	}
+}
@@ -0,0 +1,293 @@
+package tcprouter
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Load balancing strategies used to choose between the backends of a service
+const (
+	RoundRobin = "roundrobin"
+	Weighted   = "weighted"
+	LeastConn  = "leastconn"
+	SourceHash = "sourcehash"
+)
+
+// Backend is one of the targets a service forwards traffic to
+type Backend struct {
+	Addr     string `toml:"addr"`
+	TLSPort  int    `toml:"tlsport"`
+	HTTPPort int    `toml:"httpport"`
+	TCPPort  int    `toml:"tcpport"`
+	UDPPort  int    `toml:"udpport"`
+	// Weight is only used by the weighted strategy, default to 1
+	Weight int `toml:"weight"`
+}
+
+// Targets returns the list of backends of the service. If the service doesn't define
+// any backend, a single one is built from Addr and the ports of the service.
+// Ports missing from a backend are inherited from the service
+func (s Service) Targets() []Backend {
+	if len(s.Backends) == 0 {
+		return []Backend{{Addr: s.Addr, TLSPort: s.TLSPort, HTTPPort: s.HTTPPort, TCPPort: s.TCPPort, UDPPort: s.UDPPort, Weight: 1}}
+	}
+
+	targets := make([]Backend, len(s.Backends))
+	for i, b := range s.Backends {
+		if b.TLSPort == 0 {
+			b.TLSPort = s.TLSPort
+		}
+		if b.HTTPPort == 0 {
+			b.HTTPPort = s.HTTPPort
+		}
+		if b.TCPPort == 0 {
+			b.TCPPort = s.TCPPort
+		}
+		if b.UDPPort == 0 {
+			b.UDPPort = s.UDPPort
+		}
+		if b.Weight <= 0 {
+			b.Weight = 1
+		}
+		targets[i] = b
+	}
+	return targets
+}
+
+// balancer chooses a backend for each new connection of a service
+type balancer struct {
+	strategy       string
+	backends       []Backend
+	healthCheck    HealthCheckConfig
+	circuitBreaker CircuitBreakerConfig
+	breakers       []*circuitBreaker
+
+	mu sync.Mutex
+	// next backend to use for round robin
+	next int
+	// current weights for smooth weighted round robin
+	current []int
+	// number of active connections per backend
+	active []int
+}
+
+func newBalancer(service Service) (*balancer, error) {
+	strategy := service.LoadBalancer
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+
+	switch strategy {
+	case RoundRobin, Weighted, LeastConn, SourceHash:
+	default:
+		return nil, fmt.Errorf("unsupported load balancing strategy '%s'", strategy)
+	}
+
+	backends := service.Targets()
+	breakers := make([]*circuitBreaker, len(backends))
+	for i := range breakers {
+		breakers[i] = newCircuitBreaker(service.CircuitBreaker)
+	}
+
+	return &balancer{
+		strategy:       strategy,
+		backends:       backends,
+		healthCheck:    service.HealthCheck,
+		circuitBreaker: service.CircuitBreaker,
+		breakers:       breakers,
+		current:        make([]int, len(backends)),
+		active:         make([]int, len(backends)),
+	}, nil
+}
+
+// matches returns true if the balancer has been created for the same configuration as service
+func (b *balancer) matches(service Service) bool {
+	strategy := service.LoadBalancer
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	return b.strategy == strategy &&
+		b.healthCheck == service.HealthCheck &&
+		b.circuitBreaker == service.CircuitBreaker &&
+		reflect.DeepEqual(b.backends, service.Targets())
+}
+
+// pick chooses a backend among the ones for which available returns true and
+// that are not ejected by their circuit breaker, then marks it as active.
+// The caller must call release once the connection is over
+func (b *balancer) pick(src net.Addr, available func(Backend) bool) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	candidates := make([]int, 0, len(b.backends))
+	for i, backend := range b.backends {
+		if (available == nil || available(backend)) && b.breakers[i].available() {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	var picked int
+	switch b.strategy {
+	case Weighted:
+		picked = b.pickWeighted(candidates)
+	case LeastConn:
+		picked = b.pickLeastConn(candidates)
+	case SourceHash:
+		picked = b.pickSourceHash(candidates, src)
+	default:
+		picked = b.pickRoundRobin(candidates)
+	}
+
+	b.active[picked]++
+	b.breakers[picked].acquire()
+	return picked, true
+}
+
+// release marks the end of a connection to the backend i and records whether it failed
+func (b *balancer) release(i int, failed bool) {
+	b.report(i, failed)
+	b.done(i)
+}
+
+// report records the outcome of a connection to the backend i. It must be called once per
+// connection, as soon as the outcome is known, so a long lived trial connection doesn't
+// keep the backend ejected
+func (b *balancer) report(i int, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.breakers[i].report(b.backends[i].Addr, failed)
+}
+
+// done marks the end of a connection to the backend i whose outcome was already reported
+func (b *balancer) done(i int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active[i] > 0 {
+		b.active[i]--
+	}
+}
+
+func (b *balancer) pickRoundRobin(candidates []int) int {
+	for _, i := range candidates {
+		if i >= b.next {
+			b.next = i + 1
+			return i
+		}
+	}
+	b.next = candidates[0] + 1
+	return candidates[0]
+}
+
+// pickWeighted implements the smooth weighted round robin algorithm used by nginx
+func (b *balancer) pickWeighted(candidates []int) int {
+	total := 0
+	best := -1
+	for _, i := range candidates {
+		b.current[i] += b.backends[i].Weight
+		total += b.backends[i].Weight
+		if best == -1 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+func (b *balancer) pickLeastConn(candidates []int) int {
+	best := candidates[0]
+	for _, i := range candidates[1:] {
+		if b.active[i] < b.active[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+func (b *balancer) pickSourceHash(candidates []int, src net.Addr) int {
+	key := ""
+	if src != nil {
+		key = src.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return candidates[h.Sum32()%uint32(len(candidates))]
+}
+
+// errNoBackend is returned when all the backends of a service are unavailable
+var errNoBackend = errors.New("no backend available")
+
+// balancer returns the balancer of the service registered under name, creating
+// a new one if the service configuration changed since the last call
+func (s *Server) balancer(name string, service Service) (*balancer, error) {
+	s.balancersMU.Lock()
+	defer s.balancersMU.Unlock()
+
+	lb, ok := s.balancers[name]
+	if ok && lb.matches(service) {
+		return lb, nil
+	}
+
+	if err := service.validate(); err != nil {
+		return nil, err
+	}
+	lb, err := newBalancer(service)
+	if err != nil {
+		return nil, err
+	}
+	s.balancers[name] = lb
+	s.health.register(name, service)
+	return lb, nil
+}
+
+// removeBalancerLocked drops the balancer registered under name and stops the health checks
+// of its backends, must be called with the balancers lock held
+func (s *Server) removeBalancerLocked(name string) {
+	if _, ok := s.balancers[name]; !ok {
+		return
+	}
+	delete(s.balancers, name)
+	s.health.register(name, Service{})
+}
+
+// pruneBalancers removes the balancers of the services and alpn routes that were removed or changed,
+// the ones still in use are created again on the next connection. The balancers of the entrypoints
+// are removed when the entrypoints are reloaded
+func (s *Server) pruneBalancers() {
+	s.balancersMU.Lock()
+	defer s.balancersMU.Unlock()
+
+	separator := alpnServiceName("", "")
+	for name, lb := range s.balancers {
+		if _, ok := entrypointName(name); ok {
+			continue
+		}
+		service, proto := name, ""
+		if i := strings.Index(name, separator); i >= 0 {
+			service, proto = name[:i], name[i+len(separator):]
+		}
+		resolved, ok := s.services.Resolve(service)
+		if ok && proto != "" {
+			resolved, ok = resolved.ALPN[proto]
+		}
+		if !ok || !lb.matches(resolved) {
+			s.removeBalancerLocked(name)
+			log.Debug().Str("service", name).Msg("balancer of removed or changed service dropped")
+		}
+	}
+}
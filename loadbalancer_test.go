@@ -0,0 +1,80 @@
+package tcprouter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pickN(t *testing.T, lb *balancer, src net.Addr, n int) []string {
+	picked := make([]string, n)
+	for i := range picked {
+		idx, ok := lb.pick(src, nil)
+		require.True(t, ok)
+		picked[i] = lb.backends[idx].Addr
+	}
+	return picked
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	lb, err := newBalancer(Service{Backends: []Backend{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}})
+	require.NoError(t, err)
+
+	assert.Equal(t, pickN(t, lb, nil, 4), []string{"a", "b", "c", "a"})
+
+	// skip unavailable backends
+	idx, ok := lb.pick(nil, func(b Backend) bool { return b.Addr != "b" })
+	require.True(t, ok)
+	assert.Equal(t, lb.backends[idx].Addr, "c")
+
+	_, ok = lb.pick(nil, func(b Backend) bool { return false })
+	assert.Equal(t, ok, false)
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	lb, err := newBalancer(Service{
+		LoadBalancer: Weighted,
+		Backends:     []Backend{{Addr: "a", Weight: 5}, {Addr: "b", Weight: 1}, {Addr: "c", Weight: 1}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, pickN(t, lb, nil, 7), []string{"a", "a", "b", "a", "c", "a", "a"})
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	lb, err := newBalancer(Service{
+		LoadBalancer: LeastConn,
+		Backends:     []Backend{{Addr: "a"}, {Addr: "b"}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, pickN(t, lb, nil, 3), []string{"a", "b", "a"})
+	lb.release(1, false)
+	assert.Equal(t, pickN(t, lb, nil, 1), []string{"b"})
+}
+
+func TestBalancerSourceHash(t *testing.T) {
+	lb, err := newBalancer(Service{
+		LoadBalancer: SourceHash,
+		Backends:     []Backend{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}},
+	})
+	require.NoError(t, err)
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234}
+	first := pickN(t, lb, src, 1)[0]
+	src.Port = 4321
+	assert.Equal(t, pickN(t, lb, src, 3), []string{first, first, first})
+}
+
+func TestServiceTargets(t *testing.T) {
+	service := Service{Addr: "a", TLSPort: 443, HTTPPort: 80}
+	assert.Equal(t, service.Targets(), []Backend{{Addr: "a", TLSPort: 443, HTTPPort: 80, Weight: 1}})
+
+	service.Backends = []Backend{{Addr: "b", TLSPort: 8443}}
+	assert.Equal(t, service.Targets(), []Backend{{Addr: "b", TLSPort: 8443, HTTPPort: 80, Weight: 1}})
+
+	_, err := newBalancer(Service{LoadBalancer: "foo"})
+	require.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package tcprouter
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/abronan/valkeyrie/store"
+)
+
+// memStore is an in memory store.Store used in tests
+type memStore struct {
+	mu    sync.Mutex
+	pairs map[string][]byte
+	index uint64
+}
+
+func newMemStore() *memStore {
+	return &memStore{pairs: make(map[string][]byte)}
+}
+
+func (m *memStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.index++
+	m.pairs[key] = value
+	return nil
+}
+
+func (m *memStore) Get(key string, options *store.ReadOptions) (*store.KVPair, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.pairs[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return &store.KVPair{Key: key, Value: value, LastIndex: m.index}, nil
+}
+
+func (m *memStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.index++
+	delete(m.pairs, key)
+	return nil
+}
+
+func (m *memStore) Exists(key string, options *store.ReadOptions) (bool, error) {
+	_, err := m.Get(key, options)
+	return err == nil, nil
+}
+
+func (m *memStore) Watch(key string, stopCh <-chan struct{}, options *store.ReadOptions) (<-chan *store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (m *memStore) WatchTree(directory string, stopCh <-chan struct{}, options *store.ReadOptions) (<-chan []*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (m *memStore) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+func (m *memStore) List(directory string, options *store.ReadOptions) ([]*store.KVPair, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pairs []*store.KVPair
+	for key, value := range m.pairs {
+		if strings.HasPrefix(key, directory) {
+			pairs = append(pairs, &store.KVPair{Key: key, Value: value, LastIndex: m.index})
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+func (m *memStore) DeleteTree(directory string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.pairs {
+		if strings.HasPrefix(key, directory) {
+			delete(m.pairs, key)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	if err := m.Put(key, value, options); err != nil {
+		return false, nil, err
+	}
+	pair, err := m.Get(key, nil)
+	return true, pair, err
+}
+
+func (m *memStore) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	return true, m.Delete(key)
+}
+
+func (m *memStore) Close() {}
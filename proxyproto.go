@@ -0,0 +1,431 @@
+package tcprouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Supported versions of the HAProxy PROXY protocol
+// see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+const (
+	proxyV1Prefix = "PROXY "
+	// maximum size of a v1 header including the CRLF
+	proxyV1MaxLen = 107
+
+	proxyV2HeaderLen = 16
+	proxyV2Version   = 0x20
+	proxyV2CmdLocal  = 0x00
+	proxyV2CmdProxy  = 0x01
+
+	proxyV2FamUnspec = 0x00
+	proxyV2FamTCP4   = 0x11
+	proxyV2FamTCP6   = 0x21
+
+	proxyV2TypeAuthority = 0x02
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader holds the connection information carried in a PROXY protocol header
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+	// Authority is the host name requested by the client (SNI or HTTP Host).
+	// It is only sent with version 2 of the protocol
+	Authority string
+}
+
+// Write encodes the header and writes it to w
+func (h ProxyHeader) Write(w io.Writer) error {
+	var (
+		b   []byte
+		err error
+	)
+	switch h.Version {
+	case ProxyProtocolV1:
+		b = h.encodeV1()
+	case ProxyProtocolV2:
+		b, err = h.encodeV2()
+	default:
+		err = fmt.Errorf("unsupported proxy protocol version %d", h.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func (h ProxyHeader) tcpAddrs() (src, dst *net.TCPAddr, ok bool) {
+	src, ok = h.Source.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	dst, ok = h.Destination.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	return src, dst, true
+}
+
+func (h ProxyHeader) encodeV1() []byte {
+	src, dst, ok := h.tcpAddrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP4"
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		proto = "TCP6"
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port))
+}
+
+func (h ProxyHeader) encodeV2() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.Write(proxyV2Signature)
+
+	src, dst, ok := h.tcpAddrs()
+	if !ok {
+		buf.Write([]byte{proxyV2Version | proxyV2CmdLocal, proxyV2FamUnspec, 0, 0})
+		return buf.Bytes(), nil
+	}
+
+	var (
+		fam   byte = proxyV2FamTCP4
+		addrs []byte
+	)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		fam = proxyV2FamTCP6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	addrs = append(addrs, srcIP...)
+	addrs = append(addrs, dstIP...)
+	addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+
+	if h.Authority != "" {
+		if len(h.Authority) > 0xffff {
+			return nil, fmt.Errorf("authority too long")
+		}
+		addrs = append(addrs, proxyV2TypeAuthority, byte(len(h.Authority)>>8), byte(len(h.Authority)))
+		addrs = append(addrs, h.Authority...)
+	}
+
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(len(addrs)))
+	buf.Write([]byte{proxyV2Version | proxyV2CmdProxy, fam})
+	buf.Write(size)
+	buf.Write(addrs)
+
+	return buf.Bytes(), nil
+}
+
+// readProxyHeader consumes a PROXY protocol header of any version from br
+// and returns its raw bytes. If the stream doesn't start with a PROXY header
+// nothing is consumed and a nil slice is returned.
+func readProxyHeader(br *bufio.Reader) ([]byte, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		b, err := br.Peek(len(proxyV1Prefix))
+		if err != nil || string(b) != proxyV1Prefix {
+			return nil, nil
+		}
+		for i := len(proxyV1Prefix); i < proxyV1MaxLen; i++ {
+			b, err := br.Peek(i + 1)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read proxy protocol v1 header: %w", err)
+			}
+			if b[i] == '\n' && b[i-1] == '\r' {
+				return consume(br, i+1)
+			}
+		}
+		return nil, fmt.Errorf("proxy protocol v1 header too long")
+
+	case proxyV2Signature[0]:
+		b, err := br.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, nil
+		}
+		b, err = br.Peek(proxyV2HeaderLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read proxy protocol v2 header: %w", err)
+		}
+		size := int(binary.BigEndian.Uint16(b[14:16]))
+		return consume(br, proxyV2HeaderLen+size)
+	}
+
+	return nil, nil
+}
+
+func consume(br *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseProxyHeader decodes a raw PROXY protocol header as returned by readProxyHeader.
+// For headers that don't carry addresses (v1 UNKNOWN, v2 LOCAL) Source and Destination are nil
+func parseProxyHeader(raw []byte) (ProxyHeader, error) {
+	if bytes.HasPrefix(raw, proxyV2Signature) {
+		return parseProxyHeaderV2(raw)
+	}
+	return parseProxyHeaderV1(raw)
+}
+
+func parseProxyHeaderV1(raw []byte) (ProxyHeader, error) {
+	h := ProxyHeader{Version: ProxyProtocolV1}
+
+	fields := strings.Fields(strings.TrimSuffix(string(raw), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return h, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return h, fmt.Errorf("invalid proxy protocol v1 header")
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return h, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return h, err
+	}
+	h.Source, h.Destination = src, dst
+
+	return h, nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid address in proxy protocol header: %s", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in proxy protocol header: %s", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func parseProxyHeaderV2(raw []byte) (ProxyHeader, error) {
+	h := ProxyHeader{Version: ProxyProtocolV2}
+
+	if len(raw) < proxyV2HeaderLen || raw[12]&0xf0 != proxyV2Version {
+		return h, fmt.Errorf("invalid proxy protocol v2 header")
+	}
+	payload := raw[proxyV2HeaderLen:]
+	if len(payload) != int(binary.BigEndian.Uint16(raw[14:16])) {
+		return h, fmt.Errorf("invalid proxy protocol v2 header length")
+	}
+
+	switch raw[12] & 0x0f {
+	case proxyV2CmdLocal:
+		return h, nil
+	case proxyV2CmdProxy:
+	default:
+		return h, fmt.Errorf("unsupported proxy protocol v2 command %d", raw[12]&0x0f)
+	}
+
+	var ipLen int
+	switch raw[13] {
+	case proxyV2FamTCP4:
+		ipLen = net.IPv4len
+	case proxyV2FamTCP6:
+		ipLen = net.IPv6len
+	default:
+		// unsupported family, addresses must be ignored
+		return h, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return h, fmt.Errorf("proxy protocol v2 header too short")
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, payload[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, payload[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	tlvs := payload[2*ipLen+4:]
+	for len(tlvs) >= 3 {
+		size := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+size {
+			return h, fmt.Errorf("invalid proxy protocol v2 TLV")
+		}
+		if tlvs[0] == proxyV2TypeAuthority {
+			h.Authority = string(tlvs[3 : 3+size])
+		}
+		tlvs = tlvs[3+size:]
+	}
+
+	return h, nil
+}
+
+// proxiedConn is a connection whose addresses have been
+// overridden by the content of a PROXY protocol header
+type proxiedConn struct {
+	WriteCloser
+	remote net.Addr
+	local  net.Addr
+}
+
+// RemoteAddr returns the address of the original client
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+
+// LocalAddr returns the address the original client connected to
+func (c *proxiedConn) LocalAddr() net.Addr { return c.local }
+
+// Modes of acceptance of PROXY protocol headers on an entrypoint
+const (
+	ProxyProtocolOptional = "optional"
+	ProxyProtocolRequire  = "require"
+)
+
+type proxyProtocolPolicy struct {
+	required bool
+	trusted  []*net.IPNet
+}
+
+func newProxyProtocolPolicy(cfg ProxyProtocolConfig) (*proxyProtocolPolicy, error) {
+	p := &proxyProtocolPolicy{}
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case ProxyProtocolOptional:
+	case ProxyProtocolRequire:
+		p.required = true
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol mode '%s'", cfg.Mode)
+	}
+
+	// a header sent by an untrusted source would let it choose its own address
+	if len(cfg.Trusted) == 0 {
+		return nil, fmt.Errorf("proxy protocol mode '%s' requires a list of trusted sources", cfg.Mode)
+	}
+	for _, cidr := range cfg.Trusted {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy protocol source: %w", err)
+		}
+		p.trusted = append(p.trusted, ipNet)
+	}
+
+	return p, nil
+}
+
+func (p *proxyProtocolPolicy) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrap returns a handler that consumes the PROXY protocol header sent by
+// trusted sources and passes a connection carrying the original addresses to next.
+// Sources are given timeout to send their header
+func (p *proxyProtocolPolicy) wrap(next Handler, timeout time.Duration) Handler {
+	return HandlerFunc(func(conn WriteCloser) {
+		if !p.trusts(conn.RemoteAddr()) {
+			if p.required {
+				log.Error().
+					Str("remote addr", conn.RemoteAddr().String()).
+					Msg("proxy protocol required but source is not trusted")
+				conn.Close()
+				return
+			}
+			next.ServeTCP(conn)
+			return
+		}
+
+		br := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		raw, err := readProxyHeader(br)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("remote addr", conn.RemoteAddr().String()).
+				Msg("failed to read proxy protocol header")
+			conn.Close()
+			return
+		}
+		if raw == nil {
+			if p.required {
+				log.Error().
+					Str("remote addr", conn.RemoteAddr().String()).
+					Msg("proxy protocol header missing")
+				conn.Close()
+				return
+			}
+			next.ServeTCP(GetConn(conn, getPeeked(br)))
+			return
+		}
+
+		hdr, err := parseProxyHeader(raw)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("remote addr", conn.RemoteAddr().String()).
+				Msg("invalid proxy protocol header")
+			conn.Close()
+			return
+		}
+
+		proxyAddr := conn.RemoteAddr()
+		conn = GetConn(conn, getPeeked(br))
+		if hdr.Source != nil && hdr.Destination != nil {
+			conn = &proxiedConn{
+				WriteCloser: conn,
+				remote:      hdr.Source,
+				local:       hdr.Destination,
+			}
+		}
+		log.Debug().
+			Str("proxy", proxyAddr.String()).
+			Str("remote addr", conn.RemoteAddr().String()).
+			Msg("proxy protocol header accepted")
+
+		next.ServeTCP(conn)
+	})
+}
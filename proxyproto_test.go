@@ -0,0 +1,233 @@
+package tcprouter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	h := ProxyHeader{
+		Version:     ProxyProtocolV1,
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+	}
+
+	b := bytes.Buffer{}
+	err := h.Write(&b)
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n")
+
+	h.Source = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	h.Destination = &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	b.Reset()
+	err = h.Write(&b)
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")
+}
+
+func TestServiceProxyProtocolVersion(t *testing.T) {
+	for _, version := range []int{0, ProxyProtocolV1, ProxyProtocolV2} {
+		require.NoError(t, Service{Addr: "127.0.0.1", ProxyProtocol: version}.validate())
+	}
+	for _, version := range []int{-1, 3} {
+		require.Error(t, Service{Addr: "127.0.0.1", ProxyProtocol: version}.validate())
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	h := ProxyHeader{
+		Version:     ProxyProtocolV2,
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		Authority:   "example.com",
+	}
+
+	b := bytes.Buffer{}
+	err := h.Write(&b)
+	require.NoError(t, err)
+
+	raw := b.Bytes()
+	assert.Equal(t, raw[:12], proxyV2Signature)
+	assert.Equal(t, raw[12], byte(0x21))
+	assert.Equal(t, raw[13], byte(proxyV2FamTCP4))
+	// 12 bytes of addresses + 3 bytes of TLV header + authority
+	assert.Equal(t, int(raw[14])<<8|int(raw[15]), 12+3+len("example.com"))
+	assert.Equal(t, string(raw[len(raw)-len("example.com"):]), "example.com")
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+		h := ProxyHeader{
+			Version:     version,
+			Source:      &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+			Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+			Authority:   "example.com",
+		}
+
+		b := bytes.Buffer{}
+		require.NoError(t, h.Write(&b))
+		expected := append([]byte{}, b.Bytes()...)
+		b.WriteString("GET / HTTP/1.1\r\n")
+
+		br := bufio.NewReader(&b)
+		raw, err := readProxyHeader(br)
+		require.NoError(t, err)
+		assert.Equal(t, raw, expected)
+
+		rest, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, rest, "GET / HTTP/1.1\r\n")
+	}
+
+	br := bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))
+	raw, err := readProxyHeader(br)
+	require.NoError(t, err)
+	assert.Equal(t, len(raw), 0)
+	assert.Equal(t, br.Buffered(), len("GET / HTTP/1.1\r\n"))
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+		h := ProxyHeader{
+			Version:     version,
+			Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		}
+		if version == ProxyProtocolV2 {
+			h.Authority = "example.com"
+		}
+
+		b := bytes.Buffer{}
+		require.NoError(t, h.Write(&b))
+
+		parsed, err := parseProxyHeader(b.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, parsed.Version, version)
+		assert.Equal(t, parsed.Source.String(), h.Source.String())
+		assert.Equal(t, parsed.Destination.String(), h.Destination.String())
+		assert.Equal(t, parsed.Authority, h.Authority)
+	}
+
+	parsed, err := parseProxyHeader([]byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, parsed.Source, nil)
+
+	_, err = parseProxyHeader([]byte("PROXY TCP4 1.2.3.4\r\n"))
+	require.Error(t, err)
+}
+
+func TestProxyProtocolPolicy(t *testing.T) {
+	serve := func(p *proxyProtocolPolicy, payload string) (net.Addr, string) {
+		server, client := net.Pipe()
+		defer client.Close()
+
+		type result struct {
+			addr net.Addr
+			data string
+		}
+		cResult := make(chan result, 1)
+		go p.wrap(HandlerFunc(func(conn WriteCloser) {
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			cResult <- result{addr: conn.RemoteAddr(), data: line}
+		}), time.Second).ServeTCP(localPipeConn{pipeConn{server}})
+
+		client.Write([]byte(payload))
+		select {
+		case r := <-cResult:
+			return r.addr, r.data
+		case <-time.After(time.Second):
+			return nil, ""
+		}
+	}
+
+	h := ProxyHeader{
+		Version:     ProxyProtocolV1,
+		Source:      &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+	}
+	b := bytes.Buffer{}
+	require.NoError(t, h.Write(&b))
+	withHeader := b.String() + "hello\n"
+
+	trusted := []string{"127.0.0.0/8"}
+	p, err := newProxyProtocolPolicy(ProxyProtocolConfig{Mode: ProxyProtocolOptional, Trusted: trusted})
+	require.NoError(t, err)
+
+	addr, data := serve(p, withHeader)
+	assert.Equal(t, addr.String(), "192.168.0.1:56324")
+	assert.Equal(t, data, "hello\n")
+
+	addr, data = serve(p, "hello\n")
+	assert.Equal(t, addr.String(), "127.0.0.1:50000")
+	assert.Equal(t, data, "hello\n")
+
+	p, err = newProxyProtocolPolicy(ProxyProtocolConfig{Mode: ProxyProtocolRequire, Trusted: trusted})
+	require.NoError(t, err)
+	addr, _ = serve(p, "hello\n")
+	assert.Equal(t, addr, nil)
+
+	// the header of an untrusted source is not parsed
+	p, err = newProxyProtocolPolicy(ProxyProtocolConfig{Mode: ProxyProtocolOptional, Trusted: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	_, data = serve(p, withHeader)
+	assert.Equal(t, data, b.String())
+
+	_, err = newProxyProtocolPolicy(ProxyProtocolConfig{Mode: ProxyProtocolRequire, Trusted: []string{"foo"}})
+	require.Error(t, err)
+	// a mode without trusted sources would let every client spoof its address
+	_, err = newProxyProtocolPolicy(ProxyProtocolConfig{Mode: ProxyProtocolOptional})
+	require.Error(t, err)
+}
+
+func TestProxyProtocolHeaderTimeout(t *testing.T) {
+	p, err := newProxyProtocolPolicy(ProxyProtocolConfig{Mode: ProxyProtocolOptional, Trusted: []string{"127.0.0.0/8"}})
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		p.wrap(HandlerFunc(func(conn WriteCloser) {
+			conn.Close()
+		}), 200*time.Millisecond).ServeTCP(localPipeConn{pipeConn{server}})
+		close(done)
+	}()
+
+	// a header that is never completed
+	_, err = client.Write([]byte("PROX"))
+	require.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open after the header timeout")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+}
+
+// pipeConn adds a CloseWrite method to the net.Pipe connections
+type pipeConn struct {
+	net.Conn
+}
+
+func (c pipeConn) CloseWrite() error {
+	return c.Conn.Close()
+}
+
+// localPipeConn is a pipe connection coming from 127.0.0.1
+type localPipeConn struct {
+	pipeConn
+}
+
+func (localPipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
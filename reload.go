@@ -0,0 +1,395 @@
+package tcprouter
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tcpListener is a bound TCP listener. Its handler can be replaced while it accepts
+// connections, closing it stops accepting but leaves the accepted connections open
+type tcpListener struct {
+	addr    string
+	ln      *net.TCPListener
+	handler atomic.Value // Handler
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// setHandler replaces the handler of the connections accepted from now on,
+// sniff bounds the time given to read their PROXY protocol header
+func (l *tcpListener) setHandler(ppCfg ProxyProtocolConfig, sniff time.Duration, handler Handler) error {
+	pp, err := newProxyProtocolPolicy(ppCfg)
+	if err != nil {
+		return err
+	}
+	if pp != nil {
+		handler = pp.wrap(handler, sniff)
+	}
+	l.handler.Store(handler)
+	return nil
+}
+
+func (l *tcpListener) close() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		if err := l.ln.Close(); err != nil {
+			log.Error().Err(err).Str("addr", l.addr).Msg("error closing listener")
+		}
+	})
+}
+
+func (l *tcpListener) closed() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// udpListener is the bound socket of a udp entrypoint, its flows are closed with it.
+// Its configuration can be replaced while it forwards datagrams
+type udpListener struct {
+	addr string
+	ep   atomic.Value // UDPEntrypointConfig
+	ln   *net.UDPConn
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (l *udpListener) config() UDPEntrypointConfig {
+	return l.ep.Load().(UDPEntrypointConfig)
+}
+
+// setConfig replaces the configuration used for the flows created from now on
+func (l *udpListener) setConfig(ep UDPEntrypointConfig) {
+	l.ep.Store(ep)
+}
+
+func (l *udpListener) close() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		if err := l.ln.Close(); err != nil {
+			log.Error().Err(err).Str("addr", l.addr).Msg("error closing listener")
+		}
+	})
+}
+
+// staticServices resolves the services of the configuration file, they are replaced on reload
+type staticServices struct {
+	mu       sync.RWMutex
+	services map[string]Service
+}
+
+func newStaticServices(services map[string]Service) *staticServices {
+	return &staticServices{services: normalizeServices(services)}
+}
+
+// Resolve implements ServiceResolver
+func (r *staticServices) Resolve(name string) (Service, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	service, ok := r.services[name]
+	return service, ok
+}
+
+// swap replaces the services and returns the previous ones
+func (r *staticServices) swap(services map[string]Service) map[string]Service {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.services
+	r.services = services
+	return previous
+}
+
+// validateService checks service can be balanced without registering it
+func validateService(service Service) error {
+	if err := service.validate(); err != nil {
+		return err
+	}
+	_, err := newBalancer(service)
+	return err
+}
+
+// Reload applies a new configuration to the running server: the static services are replaced,
+// the http, tls and clients listeners are moved to their new address and the entrypoints are
+// added, updated, moved to their new address or removed.
+// Established connections are never closed, they keep using the configuration they were
+// accepted with. The other options can't change while the server runs, a warning is logged
+// if they differ. Nothing is applied if the configuration is invalid
+func (s *Server) Reload(opts ServerOptions, services map[string]Service) error {
+	s.reloadMU.Lock()
+	defer s.reloadMU.Unlock()
+
+	ctx := s.ctx
+	if ctx == nil {
+		return fmt.Errorf("server is not started")
+	}
+	if s.isShuttingDown() {
+		return fmt.Errorf("server is shutting down")
+	}
+	if s.static == nil && len(services) != 0 {
+		return fmt.Errorf("server has no static services to reload")
+	}
+
+	services = normalizeServices(services)
+	for name, service := range services {
+		if err := validateService(service); err != nil {
+			return fmt.Errorf("invalid service %s: %w", name, err)
+		}
+		for proto, routed := range service.ALPN {
+			if err := validateService(routed); err != nil {
+				return fmt.Errorf("invalid service %s: alpn %s: %w", name, proto, err)
+			}
+		}
+	}
+	for _, l := range s.mainListeners(opts) {
+		if _, err := newProxyProtocolPolicy(l.pp); err != nil {
+			return fmt.Errorf("invalid %s proxy protocol configuration: %w", l.id, err)
+		}
+	}
+	for name, ep := range opts.Entrypoints {
+		if err := ep.validate(); err != nil {
+			return fmt.Errorf("invalid entrypoint %s: %w", name, err)
+		}
+		if err := validateService(ep.Service); err != nil {
+			return fmt.Errorf("invalid entrypoint %s: %w", name, err)
+		}
+		if _, err := newProxyProtocolPolicy(ep.ProxyProtocol); err != nil {
+			return fmt.Errorf("invalid entrypoint %s: %w", name, err)
+		}
+	}
+	for name, ep := range opts.UDPEntrypoints {
+		if err := ep.validate(); err != nil {
+			return fmt.Errorf("invalid udp entrypoint %s: %w", name, err)
+		}
+		if err := validateService(ep.Service); err != nil {
+			return fmt.Errorf("invalid udp entrypoint %s: %w", name, err)
+		}
+	}
+
+	fixed, reloaded := s.ServerOptions, opts
+	for _, o := range []*ServerOptions{&fixed, &reloaded} {
+		o.Entrypoints, o.UDPEntrypoints = nil, nil
+		o.ListeningAddr, o.ListeningTLSPort, o.ListeningHTTPPort, o.ListeningForClientsPort = "", 0, 0, 0
+		o.ProxyProtocol = EntrypointsProxyProtocol{}
+	}
+	if !reflect.DeepEqual(fixed, reloaded) {
+		log.Warn().Msg("only services, entrypoints and listening addresses are reloaded, restart the server to apply the other changes")
+	}
+
+	if s.static != nil {
+		s.reloadServices(services)
+	}
+	current := s.options()
+	current.ListeningAddr = opts.ListeningAddr
+	current.ListeningTLSPort = opts.ListeningTLSPort
+	current.ListeningHTTPPort = opts.ListeningHTTPPort
+	current.ListeningForClientsPort = opts.ListeningForClientsPort
+	current.ProxyProtocol = opts.ProxyProtocol
+	current.Entrypoints = opts.Entrypoints
+	current.UDPEntrypoints = opts.UDPEntrypoints
+	s.reloaded.Store(current)
+
+	var failed []string
+	for _, l := range s.mainListeners(current) {
+		if err := s.reloadMainListener(l); err != nil {
+			log.Error().Err(err).Str("listener", l.id).Msg("failed to reload listener")
+			failed = append(failed, l.id)
+		}
+	}
+	for name, ep := range opts.Entrypoints {
+		if err := s.reloadEntrypoint(name, ep); err != nil {
+			log.Error().Err(err).Str("entrypoint", name).Msg("failed to reload entrypoint")
+			failed = append(failed, name)
+		}
+	}
+	for name, ep := range opts.UDPEntrypoints {
+		if err := s.reloadUDPEntrypoint(name, ep); err != nil {
+			log.Error().Err(err).Str("entrypoint", name).Msg("failed to reload udp entrypoint")
+			failed = append(failed, name)
+		}
+	}
+
+	s.listenersMU.Lock()
+	var removed []*tcpListener
+	for id, l := range s.listeners {
+		if name, ok := entrypointName(id); ok {
+			if _, keep := opts.Entrypoints[name]; !keep {
+				removed = append(removed, l)
+				delete(s.listeners, id)
+				log.Info().Str("entrypoint", name).Msg("entrypoint removed")
+			}
+		}
+	}
+	var removedUDP []*udpListener
+	for name, l := range s.udpListeners {
+		if _, keep := opts.UDPEntrypoints[name]; !keep {
+			removedUDP = append(removedUDP, l)
+			delete(s.udpListeners, name)
+			log.Info().Str("entrypoint", name).Msg("udp entrypoint removed")
+		}
+	}
+	s.listenersMU.Unlock()
+	for _, l := range removed {
+		l.close()
+	}
+	for _, l := range removedUDP {
+		l.close()
+	}
+	s.balancersMU.Lock()
+	for name := range s.balancers {
+		if ep, ok := entrypointName(name); ok {
+			_, tcp := opts.Entrypoints[ep]
+			_, udp := opts.UDPEntrypoints[ep]
+			if !tcp && !udp {
+				s.removeBalancerLocked(name)
+			}
+		}
+	}
+	s.balancersMU.Unlock()
+
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to reload listeners %v", failed)
+	}
+	return nil
+}
+
+// options returns the options of the server, with the settings applied by the last reload
+func (s *Server) options() ServerOptions {
+	if opts, ok := s.reloaded.Load().(ServerOptions); ok {
+		return opts
+	}
+	return s.ServerOptions
+}
+
+// entrypointName returns the name of the entrypoint a listener id belongs to
+func entrypointName(id string) (string, bool) {
+	prefix := entrypointServiceName("")
+	if !strings.HasPrefix(id, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(id, prefix), true
+}
+
+// reloadServices replaces the static services and logs the differences
+func (s *Server) reloadServices(services map[string]Service) {
+	for name, service := range services {
+		// the configuration has been validated already
+		s.balancer(name, service)
+		for proto, routed := range service.ALPN {
+			s.balancer(alpnServiceName(name, proto), routed)
+		}
+	}
+	previous := s.static.swap(services)
+	s.pruneBalancers()
+
+	for name, service := range services {
+		old, ok := previous[name]
+		switch {
+		case !ok:
+			log.Info().Str("service", name).Msg("service added")
+		case !reflect.DeepEqual(old, service):
+			log.Info().Str("service", name).Msg("service updated")
+		}
+	}
+	for name := range previous {
+		if _, ok := services[name]; !ok {
+			log.Info().Str("service", name).Msg("service removed")
+		}
+	}
+}
+
+// rebind replaces the handler of the listener registered under id when its address is unchanged,
+// else binds the new address before closing the previous listener. It returns the previous
+// listener, nil if there was none
+func (s *Server) rebind(id, addr string, ppCfg ProxyProtocolConfig, handler Handler) (*tcpListener, error) {
+	s.listenersMU.Lock()
+	previous := s.listeners[id]
+	s.listenersMU.Unlock()
+
+	if previous != nil && previous.addr == addr {
+		return previous, previous.setHandler(ppCfg, s.ServerOptions.Timeouts.sniff(), handler)
+	}
+	if err := s.listen(s.ctx, id, addr, ppCfg, handler); err != nil {
+		return previous, err
+	}
+	if previous != nil {
+		previous.close()
+	}
+	return previous, nil
+}
+
+// reloadMainListener rebinds the http, tls or clients listener l
+func (s *Server) reloadMainListener(l mainListener) error {
+	previous, err := s.rebind(l.id, l.addr, l.pp, l.handler)
+	if err == nil && previous != nil && previous.addr != l.addr {
+		log.Info().Str("listener", l.id).Str("addr", l.addr).Str("previous addr", previous.addr).Msg("listener moved")
+	}
+	return err
+}
+
+// reloadEntrypoint replaces the handler of the listener of the entrypoint when its address
+// is unchanged, else binds the new address before closing the previous listener
+func (s *Server) reloadEntrypoint(name string, ep EntrypointConfig) error {
+	id := entrypointServiceName(name)
+	if _, err := s.balancer(id, ep.service()); err != nil {
+		return err
+	}
+	handler := s.limitConnections(trafficTCP, s.entrypointHandler(name, ep))
+	addr := s.options().EntrypointAddr(ep)
+
+	previous, err := s.rebind(id, addr, ep.ProxyProtocol, handler)
+	switch {
+	case err != nil:
+		return err
+	case previous == nil:
+		log.Info().Str("entrypoint", name).Str("addr", addr).Msg("entrypoint added")
+	case previous.addr != addr:
+		log.Info().Str("entrypoint", name).Str("addr", addr).Str("previous addr", previous.addr).Msg("entrypoint moved")
+	}
+	return nil
+}
+
+// reloadUDPEntrypoint replaces the configuration of the socket of the udp entrypoint when
+// its address is unchanged, its flows are kept. Else the new address is bound before the
+// previous socket and its flows are closed
+func (s *Server) reloadUDPEntrypoint(name string, ep UDPEntrypointConfig) error {
+	if _, err := s.balancer(entrypointServiceName(name), ep.service()); err != nil {
+		return err
+	}
+	addr := s.options().UDPEntrypointAddr(ep)
+
+	s.listenersMU.Lock()
+	previous := s.udpListeners[name]
+	s.listenersMU.Unlock()
+
+	if previous != nil && previous.addr == addr {
+		if !reflect.DeepEqual(previous.config(), ep) {
+			previous.setConfig(ep)
+			log.Info().Str("entrypoint", name).Str("addr", addr).Msg("udp entrypoint updated")
+		}
+		return nil
+	}
+	if err := s.listenUDP(s.ctx, name, ep); err != nil {
+		return err
+	}
+	if previous != nil {
+		previous.close()
+		log.Info().Str("entrypoint", name).Str("addr", addr).Str("previous addr", previous.addr).Msg("udp entrypoint moved")
+	} else {
+		log.Info().Str("entrypoint", name).Str("addr", addr).Msg("udp entrypoint added")
+	}
+	return nil
+}
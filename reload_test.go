@@ -0,0 +1,283 @@
+package tcprouter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	backend := lineEcho(t)
+	defer backend.Close()
+	backendPort := backend.Addr().(*net.TCPAddr).Port
+
+	entrypoint := func(port int) EntrypointConfig {
+		return EntrypointConfig{Port: uint(port), Service: Service{Addr: "127.0.0.1", TCPPort: backendPort}}
+	}
+	keptPort, movedPort, newPort := closedPort(t), closedPort(t), closedPort(t)
+	opts := ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        uint(closedPort(t)),
+		ListeningHTTPPort:       uint(closedPort(t)),
+		ListeningForClientsPort: uint(closedPort(t)),
+		Entrypoints: map[string]EntrypointConfig{
+			"kept":  entrypoint(keptPort),
+			"moved": entrypoint(movedPort),
+		},
+	}
+	s := NewServer(opts, nil, map[string]Service{"a.com": {Addr: "127.0.0.1"}})
+	require.Error(t, s.Reload(opts, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+	addr := func(port int) string { return fmt.Sprintf("127.0.0.1:%d", port) }
+	waitListening(t, addr(keptPort))
+	waitListening(t, addr(movedPort))
+
+	dial := func(port int) net.Conn {
+		conn, err := net.Dial("tcp", addr(port))
+		require.NoError(t, err)
+		return conn
+	}
+	echo := func(conn net.Conn) {
+		_, err := conn.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, line, "hello\n")
+	}
+	kept, moved := dial(keptPort), dial(movedPort)
+	defer kept.Close()
+	defer moved.Close()
+
+	// an invalid configuration changes nothing
+	invalid := opts
+	invalid.Entrypoints = map[string]EntrypointConfig{"broken": {Port: uint(newPort)}}
+	require.Error(t, s.Reload(invalid, map[string]Service{"b.com": {Addr: "127.0.0.1"}}))
+	_, _, ok := s.lookupService("a.com")
+	assert.Equal(t, ok, true)
+
+	reloaded := opts
+	reloaded.Entrypoints = map[string]EntrypointConfig{
+		"kept":  entrypoint(keptPort),
+		"moved": entrypoint(newPort),
+	}
+	require.NoError(t, s.Reload(reloaded, map[string]Service{"B.com": {Addr: "127.0.0.1"}}))
+
+	_, _, ok = s.lookupService("a.com")
+	assert.Equal(t, ok, false)
+	_, _, ok = s.lookupService("b.com")
+	assert.Equal(t, ok, true)
+
+	// the established connections are kept, including the ones of the moved listener
+	echo(kept)
+	echo(moved)
+
+	_, err := net.Dial("tcp", addr(movedPort))
+	require.Error(t, err)
+	conn := dial(newPort)
+	defer conn.Close()
+	echo(conn)
+	conn = dial(keptPort)
+	defer conn.Close()
+	echo(conn)
+
+	// removed entrypoints stop listening
+	reloaded.Entrypoints = map[string]EntrypointConfig{"kept": entrypoint(keptPort)}
+	require.NoError(t, s.Reload(reloaded, nil))
+	_, err = net.Dial("tcp", addr(newPort))
+	require.Error(t, err)
+}
+
+func TestReloadUDPEntrypoint(t *testing.T) {
+	// backend answering with the address of the flow sending the datagram
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_, src, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteToUDP([]byte(src.String()), src)
+		}
+	}()
+
+	ep := UDPEntrypointConfig{Service: Service{Addr: "127.0.0.1", UDPPort: backend.LocalAddr().(*net.UDPAddr).Port}}
+	s, addr := udpEntrypointServer(t, ServerOptions{}, ep)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, s)
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	flow := func(conn net.Conn) string {
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+	before := flow(conn)
+
+	// a new configuration on the same address keeps the flows
+	opts := s.ServerOptions
+	updated := opts.UDPEntrypoints["echo"]
+	updated.IdleTimeout = 120
+	updated.MaxFlows = 10
+	opts.UDPEntrypoints = map[string]UDPEntrypointConfig{"echo": updated}
+	require.NoError(t, s.Reload(opts, nil))
+	assert.Equal(t, flow(conn), before)
+
+	// a moved entrypoint is bound on its new address
+	moved := updated
+	moved.Port = uint(freeUDPPort(t))
+	opts.UDPEntrypoints = map[string]UDPEntrypointConfig{"echo": moved}
+	require.NoError(t, s.Reload(opts, nil))
+	conn, err = net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", moved.Port))
+	require.NoError(t, err)
+	defer conn.Close()
+	flow(conn)
+}
+
+func TestReloadRemovedServiceHealthCheck(t *testing.T) {
+	// backend counting the health check probes
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	var probes int32
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&probes, 1)
+			conn.Close()
+		}
+	}()
+
+	checked := Service{
+		Addr:        "127.0.0.1",
+		TCPPort:     backend.Addr().(*net.TCPAddr).Port,
+		HealthCheck: HealthCheckConfig{Type: HealthCheckTCP, Interval: 1},
+	}
+	services := map[string]Service{
+		"a.com": checked,
+		"b.com": {Addr: "127.0.0.1", ALPN: map[string]Service{"h2": checked}},
+	}
+	s := NewServer(ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        uint(closedPort(t)),
+		ListeningHTTPPort:       uint(closedPort(t)),
+		ListeningForClientsPort: uint(closedPort(t)),
+	}, nil, services)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+	for i := 0; i < 50 && atomic.LoadInt32(&probes) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NotEqual(t, atomic.LoadInt32(&probes), int32(0))
+
+	// dropping the route of b.com keeps the target probed for a.com
+	services["b.com"] = Service{Addr: "127.0.0.1"}
+	require.NoError(t, s.Reload(s.ServerOptions, services))
+	s.balancersMU.Lock()
+	_, ok := s.balancers[alpnServiceName("b.com", "h2")]
+	s.balancersMU.Unlock()
+	assert.Equal(t, ok, false)
+	s.health.mu.Lock()
+	assert.Equal(t, len(s.health.targets), 1)
+	s.health.mu.Unlock()
+
+	require.NoError(t, s.Reload(s.ServerOptions, map[string]Service{"b.com": {Addr: "127.0.0.1"}}))
+	s.balancersMU.Lock()
+	_, ok = s.balancers["a.com"]
+	s.balancersMU.Unlock()
+	assert.Equal(t, ok, false)
+
+	// the probes stop once the service is removed
+	time.Sleep(200 * time.Millisecond)
+	stopped := atomic.LoadInt32(&probes)
+	time.Sleep(2500 * time.Millisecond)
+	assert.Equal(t, atomic.LoadInt32(&probes), stopped)
+}
+
+func TestReloadMainListeners(t *testing.T) {
+	backend := lineEcho(t)
+	defer backend.Close()
+	services := map[string]Service{"a.com": {Addr: "127.0.0.1", HTTPPort: backend.Addr().(*net.TCPAddr).Port}}
+	opts := ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        uint(closedPort(t)),
+		ListeningHTTPPort:       uint(closedPort(t)),
+		ListeningForClientsPort: uint(closedPort(t)),
+	}
+	s := NewServer(opts, nil, services)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, s)
+	waitListening(t, opts.HTTPAddr())
+
+	// an established connection survives the move of its listener
+	conn, err := net.Dial("tcp", opts.HTTPAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	moved := opts
+	moved.ListeningHTTPPort = uint(closedPort(t))
+	moved.ListeningForClientsPort = uint(closedPort(t))
+	require.NoError(t, s.Reload(moved, services))
+	waitListening(t, moved.HTTPAddr())
+	waitListening(t, moved.ClientsAddr())
+	waitListening(t, moved.TLSAddr())
+	_, err = net.Dial("tcp", opts.HTTPAddr())
+	require.Error(t, err)
+	_, err = net.Dial("tcp", opts.ClientsAddr())
+	require.Error(t, err)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "GET / HTTP/1.1\r\n")
+
+	// an invalid proxy protocol configuration changes nothing
+	invalid := moved
+	invalid.ListeningTLSPort = uint(closedPort(t))
+	invalid.ProxyProtocol.TLS = ProxyProtocolConfig{Mode: ProxyProtocolRequire}
+	require.Error(t, s.Reload(invalid, services))
+	waitListening(t, moved.TLSAddr())
+
+	// redirects point to the reloaded tls port
+	redirected := moved
+	redirected.ListeningTLSPort = uint(closedPort(t))
+	services = map[string]Service{"r.com": {Addr: "127.0.0.1", HTTPSRedirect: http.StatusMovedPermanently}}
+	require.NoError(t, s.Reload(redirected, services))
+	conn, err = net.Dial("tcp", redirected.HTTPAddr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: r.com\r\n\r\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Location"), fmt.Sprintf("https://r.com:%d/", redirected.ListeningTLSPort))
+}
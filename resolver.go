@@ -0,0 +1,519 @@
+package tcprouter
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// TTL used for the addresses resolved by the system resolver, which doesn't expose the records TTL
+	defaultResolveTTL = 30 * time.Second
+	// resolved addresses are kept at least this long to avoid querying the DNS for every connection
+	minResolveTTL = time.Second
+	// failed resolutions are retried after this delay
+	negativeResolveTTL = 5 * time.Second
+	dnsQueryTimeout    = 2 * time.Second
+	// delay before trying the next address of a backend, see RFC 8305
+	happyEyeballsDelay = 250 * time.Millisecond
+	// delay between the checks for changes of the resolv.conf and hosts files
+	systemDNSCheckInterval = 5 * time.Second
+)
+
+// systemResolver is the configuration of the system resolver shared by the resolvers of all the servers
+var systemResolver = newSystemDNS("/etc/resolv.conf", "/etc/hosts")
+
+// lookupFunc resolves host into its addresses and returns how long they can be cached
+type lookupFunc func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+
+type resolvedHost struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// resolveCall is a lookup in progress, shared by the connections resolving the same host
+type resolveCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+	// set when the lookup was interrupted by the context of the connection running it
+	canceled bool
+}
+
+// resolver resolves the hostnames of the backends and caches the addresses for the TTL of their DNS records.
+// Concurrent resolutions of the same host share a single lookup
+type resolver struct {
+	lookup lookupFunc
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+	calls map[string]*resolveCall
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		lookup: systemResolver.lookup,
+		now:    time.Now,
+		cache:  make(map[string]resolvedHost),
+		calls:  make(map[string]*resolveCall),
+	}
+}
+
+// resolve returns the addresses of host. IP addresses are returned as is
+func (r *resolver) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var call *resolveCall
+	for {
+		r.mu.Lock()
+		cached, ok := r.cache[host]
+		if ok && r.now().Before(cached.expires) {
+			r.mu.Unlock()
+			return cached.ips, cached.err
+		}
+		running := false
+		call, running = r.calls[host]
+		if !running {
+			call = &resolveCall{done: make(chan struct{})}
+			r.calls[host] = call
+		}
+		r.mu.Unlock()
+
+		if !running {
+			break
+		}
+		select {
+		case <-call.done:
+			// the connection running the lookup went away, its error says nothing about the host
+			if !call.canceled {
+				return call.ips, call.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ips, ttl, err := r.lookup(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no address found")
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to resolve backend host '%s': %w", host, err)
+		log.Error().Err(err).Str("host", host).Msg("dns resolution failed")
+		ips, ttl = nil, negativeResolveTTL
+	} else if ttl < minResolveTTL {
+		ttl = minResolveTTL
+	}
+
+	r.mu.Lock()
+	now := r.now()
+	// the hosts of removed backends are not resolved again, drop them once expired
+	for name, cached := range r.cache {
+		if !now.Before(cached.expires) {
+			delete(r.cache, name)
+		}
+	}
+	// a canceled lookup says nothing about the host
+	canceled := ctx.Err() != nil
+	if !canceled {
+		r.cache[host] = resolvedHost{ips: ips, err: err, expires: now.Add(ttl)}
+	}
+	delete(r.calls, host)
+	r.mu.Unlock()
+
+	call.ips, call.err, call.canceled = ips, err, canceled
+	close(call.done)
+	return ips, err
+}
+
+// dnsConfig is the part of a resolv.conf file used to query the nameservers directly
+type dnsConfig struct {
+	servers []string
+	ndots   int
+	// set when options changing how names are resolved are used, e.g. use-vc or no-aaaa
+	unsupported bool
+}
+
+// readResolvConf parses the resolv.conf file at path
+func readResolvConf(path string) dnsConfig {
+	conf := dnsConfig{ndots: 1}
+	f, err := os.Open(path)
+	if err != nil {
+		return conf
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if net.ParseIP(fields[1]) != nil {
+				conf.servers = append(conf.servers, net.JoinHostPort(fields[1], "53"))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				name, value := option, ""
+				if i := strings.IndexByte(option, ':'); i >= 0 {
+					name, value = option[:i], option[i+1:]
+				}
+				switch name {
+				case "ndots":
+					if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+						if n > 15 {
+							n = 15
+						}
+						conf.ndots = n
+					}
+				// these only change how the nameservers are queried, not the answers
+				case "timeout", "attempts", "rotate", "edns0", "trust-ad", "single-request", "single-request-reopen":
+				default:
+					conf.unsupported = true
+				}
+			}
+		}
+	}
+	return conf
+}
+
+// direct returns true if host can be queried as is on the nameservers. The names with less dots
+// than ndots are first looked up in the search domains, which only the system resolver does
+func (c dnsConfig) direct(host string) bool {
+	if len(c.servers) == 0 || c.unsupported {
+		return false
+	}
+	return strings.HasSuffix(host, ".") || strings.Count(host, ".") >= c.ndots
+}
+
+// readHostsFile returns the names defined in the hosts file at path, in lower case
+func readHostsFile(path string) map[string]bool {
+	hosts := make(map[string]bool)
+	f, err := os.Open(path)
+	if err != nil {
+		return hosts
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range fields[1:] {
+			hosts[strings.ToLower(strings.TrimSuffix(name, "."))] = true
+		}
+	}
+	return hosts
+}
+
+// modTime returns the modification time of the file at path, zero if it can't be read
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// systemDNS resolves names like the system does while getting the TTL of the records when possible.
+// The resolv.conf and hosts files are parsed once and read again when they change, which is
+// checked at most every systemDNSCheckInterval
+type systemDNS struct {
+	resolvConf string
+	hostsFile  string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	checked   time.Time
+	loaded    bool
+	confTime  time.Time
+	hostsTime time.Time
+	conf      dnsConfig
+	hosts     map[string]bool
+}
+
+func newSystemDNS(resolvConf, hostsFile string) *systemDNS {
+	return &systemDNS{resolvConf: resolvConf, hostsFile: hostsFile, now: time.Now}
+}
+
+// config returns the parsed resolv.conf and hosts files
+func (d *systemDNS) config() (dnsConfig, map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if d.loaded && now.Sub(d.checked) < systemDNSCheckInterval {
+		return d.conf, d.hosts
+	}
+	d.checked = now
+
+	if t := modTime(d.resolvConf); !d.loaded || !t.Equal(d.confTime) {
+		d.conf, d.confTime = readResolvConf(d.resolvConf), t
+	}
+	if t := modTime(d.hostsFile); !d.loaded || !t.Equal(d.hostsTime) {
+		d.hosts, d.hostsTime = readHostsFile(d.hostsFile), t
+	}
+	d.loaded = true
+	return d.conf, d.hosts
+}
+
+// lookup queries the nameservers of the system to get the TTL of the records. The names it would
+// resolve differently from the system resolver, e.g. the ones defined in the hosts file or subject
+// to the search domains, and the failed queries are resolved by the system resolver instead
+func (d *systemDNS) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	conf, hosts := d.config()
+	if conf.direct(host) && !hosts[strings.ToLower(strings.TrimSuffix(host, "."))] {
+		ips, ttl, err := queryAddrs(ctx, conf.servers, host)
+		if err == nil && len(ips) != 0 {
+			return ips, ttl, nil
+		}
+		log.Debug().Err(err).Str("host", host).Msg("dns query failed, using system resolver")
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, defaultResolveTTL, nil
+}
+
+// queryAddrs resolves the A and AAAA records of host on the first nameserver answering.
+// The addresses of a family are used even if the query of the other one failed
+func queryAddrs(ctx context.Context, servers []string, host string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, server := range servers {
+		var (
+			ips []net.IP
+			ttl time.Duration
+		)
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+			found, qttl, err := queryDNS(ctx, server, host, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if len(found) != 0 && (ttl == 0 || qttl < ttl) {
+				ttl = qttl
+			}
+			ips = append(ips, found...)
+		}
+		if len(ips) != 0 {
+			return ips, ttl, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no address found")
+	}
+	return nil, 0, lastErr
+}
+
+var errNameNotFound = errors.New("no such host")
+
+// queryDNS sends a single query for the records of type qtype of host to server and
+// returns the addresses found with the lowest TTL of the answers, CNAME records included
+func queryDNS(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the id must not be predictable to make spoofed answers harder
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(packed); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1232)
+	var resp dnsmessage.Message
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := resp.Unpack(buf[:n]); err != nil {
+			return nil, 0, err
+		}
+		// ignore stray answers and the ones to another question
+		if resp.Header.ID == id && resp.Header.Response && answers(resp, query.Questions[0]) {
+			break
+		}
+	}
+
+	switch {
+	case resp.Header.RCode == dnsmessage.RCodeNameError:
+		return nil, 0, errNameNotFound
+	case resp.Header.RCode != dnsmessage.RCodeSuccess:
+		return nil, 0, fmt.Errorf("dns server %s answered %s", server, resp.Header.RCode)
+	case resp.Header.Truncated:
+		return nil, 0, fmt.Errorf("dns answer truncated")
+	}
+
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+	for i, answer := range resp.Answers {
+		if i == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// answers returns true if resp is the answer to question q
+func answers(resp dnsmessage.Message, q dnsmessage.Question) bool {
+	if len(resp.Questions) != 1 {
+		return false
+	}
+	got := resp.Questions[0]
+	return got.Type == q.Type && got.Class == q.Class && strings.EqualFold(got.Name.String(), q.Name.String())
+}
+
+// sortAddrs orders ips for happy eyeballs: IPv6 and IPv4 addresses are interleaved,
+// starting with IPv6
+func sortAddrs(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs connects to the first of ips accepting a connection on port.
+// A new attempt is started every happyEyeballsDelay or as soon as the previous one failed,
+// the attempts still running once a connection succeeded are canceled
+func dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, ips []net.IP, port int) (net.Conn, error) {
+	ips = sortAddrs(ips)
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ips[0].String(), strconv.Itoa(port)))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	attempt := func(ip net.IP) {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		select {
+		case results <- dialResult{conn: conn, err: err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	next, running := 0, 0
+	var firstErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case res := <-results:
+			running--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next == len(ips) && running == 0 {
+				return nil, firstErr
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if next < len(ips) {
+			go attempt(ips[next])
+			next++
+			running++
+			timer.Reset(happyEyeballsDelay)
+		}
+	}
+}
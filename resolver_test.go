@@ -0,0 +1,311 @@
+package tcprouter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverCache(t *testing.T) {
+	now := time.Now()
+	lookups := 0
+	var lookupErr error
+	r := newResolver()
+	r.now = func() time.Time { return now }
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		lookups++
+		if lookupErr != nil {
+			return nil, 0, lookupErr
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, 10 * time.Second, nil
+	}
+
+	ips, err := r.resolve(context.Background(), "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, ips[0].String(), "10.0.0.2")
+	assert.Equal(t, lookups, 0)
+
+	ips, err = r.resolve(context.Background(), "backend.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ips[0].String(), "10.0.0.1")
+	_, err = r.resolve(context.Background(), "backend.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, lookups, 1)
+
+	// the addresses expire with the TTL of the records
+	now = now.Add(11 * time.Second)
+	lookupErr = errors.New("no such host")
+	_, err = r.resolve(context.Background(), "backend.example.com")
+	require.Error(t, err)
+	assert.Equal(t, lookups, 2)
+
+	// failures are cached for a short time
+	_, err = r.resolve(context.Background(), "backend.example.com")
+	require.Error(t, err)
+	assert.Equal(t, lookups, 2)
+	now = now.Add(negativeResolveTTL)
+	lookupErr = nil
+	_, err = r.resolve(context.Background(), "backend.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, lookups, 3)
+}
+
+func TestResolverSharedLookups(t *testing.T) {
+	now := time.Now()
+	var lookups int32
+	release := make(chan struct{})
+	r := newResolver()
+	r.now = func() time.Time { return now }
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-release
+		return []net.IP{net.ParseIP("10.0.0.1")}, 10 * time.Second, nil
+	}
+
+	// concurrent resolutions of a host share the same lookup
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.resolve(context.Background(), "a.example.com")
+			require.NoError(t, err)
+			assert.Equal(t, ips[0].String(), "10.0.0.1")
+		}()
+	}
+	for atomic.LoadInt32(&lookups) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, atomic.LoadInt32(&lookups), int32(1))
+
+	// expired entries are evicted
+	now = now.Add(11 * time.Second)
+	_, err := r.resolve(context.Background(), "b.example.com")
+	require.NoError(t, err)
+	_, ok := r.cache["a.example.com"]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, len(r.cache), 1)
+}
+
+func TestResolverLeaderCanceled(t *testing.T) {
+	var lookups int32
+	r := newResolver()
+	r.lookup = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		if atomic.AddInt32(&lookups, 1) == 1 {
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, 10 * time.Second, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := r.resolve(ctx, "a.example.com")
+		leader <- err
+	}()
+	for atomic.LoadInt32(&lookups) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a follower of a canceled lookup runs its own
+	follower := make(chan error)
+	go func() {
+		ips, err := r.resolve(context.Background(), "a.example.com")
+		if err == nil {
+			assert.Equal(t, ips[0].String(), "10.0.0.1")
+		}
+		follower <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, errors.Is(<-leader, context.Canceled), true)
+	require.NoError(t, <-follower)
+	assert.Equal(t, atomic.LoadInt32(&lookups), int32(2))
+}
+
+// dnsServer starts a DNS server answering the A queries for backend.example.com
+// with a CNAME and an A record, and failing its AAAA queries
+func dnsServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			q := query.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+				Questions: query.Questions,
+			}
+			switch {
+			case q.Name.String() != "backend.example.com.":
+				resp.Header.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeAAAA:
+				resp.Header.RCode = dnsmessage.RCodeServerFailure
+			case q.Type == dnsmessage.TypeA:
+				target := dnsmessage.MustNewName("lb.example.com.")
+				resp.Answers = []dnsmessage.Resource{
+					{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+						Body:   &dnsmessage.CNAMEResource{CNAME: target},
+					},
+					{
+						Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 42},
+						Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+					},
+				}
+			}
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(packed, addr)
+		}
+	}()
+	return pc
+}
+
+func TestQueryAddrs(t *testing.T) {
+	pc := dnsServer(t)
+	defer pc.Close()
+	servers := []string{pc.LocalAddr().String()}
+
+	ips, ttl, err := queryAddrs(context.Background(), servers, "backend.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, len(ips), 1)
+	assert.Equal(t, ips[0].String(), "10.0.0.1")
+	assert.Equal(t, ttl, 42*time.Second)
+
+	_, _, err = queryAddrs(context.Background(), servers, "unknown.example.com")
+	assert.Equal(t, err, errNameNotFound)
+}
+
+func TestSystemDNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	resolvConf, hostsFile := filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "hosts")
+	require.NoError(t, ioutil.WriteFile(resolvConf, []byte("nameserver 10.0.0.53\nsearch example.com\noptions ndots:2 timeout:1\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(hostsFile, []byte("10.0.0.1 local.example.org # comment\n"), 0600))
+
+	now := time.Now()
+	d := newSystemDNS(resolvConf, hostsFile)
+	d.now = func() time.Time { return now }
+
+	conf, hosts := d.config()
+	assert.Equal(t, conf.servers, []string{"10.0.0.53:53"})
+	assert.Equal(t, conf.ndots, 2)
+	assert.Equal(t, hosts["local.example.org"], true)
+	// the names with less dots than ndots go through the search domains
+	assert.Equal(t, conf.direct("www.example.org"), true)
+	assert.Equal(t, conf.direct("example.org"), false)
+	assert.Equal(t, conf.direct("example.org."), true)
+
+	// the files are read again once changed
+	require.NoError(t, ioutil.WriteFile(resolvConf, []byte("nameserver 10.0.0.54\noptions use-vc\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(resolvConf, later, later))
+	conf, _ = d.config()
+	assert.Equal(t, conf.servers, []string{"10.0.0.53:53"})
+	now = now.Add(systemDNSCheckInterval)
+	conf, _ = d.config()
+	assert.Equal(t, conf.servers, []string{"10.0.0.54:53"})
+	assert.Equal(t, conf.ndots, 1)
+	// the options changing the answers are left to the system resolver
+	assert.Equal(t, conf.direct("www.example.org"), false)
+}
+
+func TestSortAddrs(t *testing.T) {
+	var ips []net.IP
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "fd00::1", "10.0.0.3"} {
+		ips = append(ips, net.ParseIP(ip))
+	}
+
+	var sorted []string
+	for _, ip := range sortAddrs(ips) {
+		sorted = append(sorted, ip.String())
+	}
+	assert.Equal(t, sorted, []string{"fd00::1", "10.0.0.1", "10.0.0.2", "10.0.0.3"})
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// 192.0.2.1 is a documentation address that never answers, the IPv6
+	// loopback refuses the connection if nothing listens on this port
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("::1"), net.ParseIP("127.0.0.1")}
+	start := time.Now()
+	conn, err := dialHappyEyeballs(context.Background(), &net.Dialer{Timeout: 5 * time.Second}, ips, port)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, conn.RemoteAddr().String(), "127.0.0.1:"+strconv.Itoa(port))
+	assert.Equal(t, time.Since(start) < 2*time.Second, true)
+
+	_, err = dialHappyEyeballs(context.Background(), &net.Dialer{}, []net.IP{net.ParseIP("127.0.0.1")}, closedPort(t))
+	require.Error(t, err)
+}
+
+func TestQueryDNSIgnoresOtherQuestions(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			return
+		}
+		answer := func(name string, a [4]byte) {
+			q := query.Questions[0]
+			q.Name = dnsmessage.MustNewName(name)
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+				Questions: []dnsmessage.Question{q},
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: a},
+				}},
+			}
+			packed, _ := resp.Pack()
+			pc.WriteTo(packed, addr)
+		}
+		// an answer with the right id to another question is ignored
+		answer("evil.example.com.", [4]byte{10, 6, 6, 6})
+		answer("Backend.Example.com.", [4]byte{10, 0, 0, 1})
+	}()
+
+	ips, _, err := queryDNS(context.Background(), pc.LocalAddr().String(), "backend.example.com", dnsmessage.TypeA)
+	require.NoError(t, err)
+	assert.Equal(t, len(ips), 1)
+	assert.Equal(t, ips[0].String(), "10.0.0.1")
+}
@@ -3,11 +3,11 @@ package tcprouter
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-yamux"
@@ -22,6 +22,29 @@ type ServerOptions struct {
 	ListeningTLSPort        uint
 	ListeningHTTPPort       uint
 	ListeningForClientsPort uint
+
+	// ProxyProtocol configures the acceptance of PROXY protocol headers on each listener
+	ProxyProtocol EntrypointsProxyProtocol
+
+	// Entrypoints are additional listeners forwarding raw TCP traffic, indexed by name
+	Entrypoints map[string]EntrypointConfig
+	// UDPEntrypoints are listeners forwarding UDP datagrams, indexed by name
+	UDPEntrypoints map[string]UDPEntrypointConfig
+
+	// ACME configures the issuance of certificates for the services with acme enabled
+	ACME ACMEConfig
+	// HTTP configures how the HTTP listener parses and routes requests
+	HTTP HTTPConfig
+	// Access restricts the sources allowed to reach the services that don't define their own lists
+	Access AccessConfig
+	// Limits caps the rate and number of connections accepted
+	Limits LimitsConfig
+	// Timeouts bounds how long connections are kept open
+	Timeouts TimeoutsConfig
+	// DbRefresh is the interval in seconds at which the services of the db backend are reloaded
+	DbRefresh uint
+	// ServicesDir is a directory watched for files defining services
+	ServicesDir string
 }
 
 // HTTPAddr returns the HTTP listener address
@@ -41,120 +64,276 @@ func (o ServerOptions) ClientsAddr() string {
 
 //Server is tcp router server
 type Server struct {
+	// ServerOptions are the options the server was created with, the listening addresses,
+	// proxy protocol settings and entrypoints applied by Reload are not reflected here
 	ServerOptions ServerOptions
 	DbStore       store.Store
-	Services      map[string]Service
-
-	activeConnections map[string]*yamux.Session
-
-	listeners   []net.Listener
-	listenersMU sync.Mutex
-	wg          sync.WaitGroup
+	// Services are the static services the server was created with
+	Services map[string]Service
+
+	// tunnel sessions opened by the clients indexed by secret
+	activeConnections   map[string][]*tunnelSession
+	activeConnectionsMU sync.Mutex
+
+	balancers   map[string]*balancer
+	balancersMU sync.Mutex
+	health      *healthChecker
+	// access keeps the parsed access lists of the services
+	access accessCache
+
+	certificates *certificateStore
+	resolver     *resolver
+	acme         *acmeManager
+	limiter      *limiter
+	services     ServiceResolver
+
+	// listeners are indexed by http, tls, clients and the service name of the entrypoints,
+	// udpListeners by the name of the udp entrypoints
+	listeners    map[string]*tcpListener
+	udpListeners map[string]*udpListener
+	listenersMU  sync.Mutex
+	wg           sync.WaitGroup
+
+	// static holds the services of the configuration, nil if the server was created with a resolver
+	static *staticServices
+	// reloaded holds the ServerOptions with the settings applied by the last reload
+	reloaded atomic.Value
+	// ctx is the context the server was started with, reloads are serialized by reloadMU
+	ctx      context.Context
+	reloadMU sync.Mutex
+
+	// connections accepted by the listeners and not done yet
+	conns   map[WriteCloser]struct{}
+	connsMU sync.Mutex
+	// shutdown is closed when Shutdown is called, drained once it returned
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	drained      chan struct{}
 }
 
-// NewServer creates a new server
+// NewServer creates a new server forwarding to the static services first, then to the services
+// of the services directory if configured and to the services of the db backend store if not nil
 func NewServer(forwardOptions ServerOptions, store store.Store, services map[string]Service) *Server {
-	if services == nil {
-		services = make(map[string]Service)
+	static := newStaticServices(services)
+	resolver := ChainResolver{static}
+	if forwardOptions.ServicesDir != "" {
+		resolver = append(resolver, NewDirectoryResolver(forwardOptions.ServicesDir, defaultServiceRefresh))
+	}
+	if store != nil {
+		resolver = append(resolver, NewKVResolver(store, time.Duration(forwardOptions.DbRefresh)*time.Second))
 	}
 
-	return &Server{
+	s := NewServerWithResolver(forwardOptions, store, resolver)
+	s.static = static
+	s.Services = static.services
+	return s
+}
+
+// NewServerWithResolver creates a new server forwarding to the services found by resolver.
+// store, if not nil, keeps the certificates of the services
+func NewServerWithResolver(forwardOptions ServerOptions, store store.Store, resolver ServiceResolver) *Server {
+	s := &Server{
 		ServerOptions:     forwardOptions,
-		Services:          services,
 		DbStore:           store,
-		activeConnections: make(map[string]*yamux.Session),
-		listeners:         []net.Listener{},
+		services:          resolver,
+		activeConnections: make(map[string][]*tunnelSession),
+		balancers:         make(map[string]*balancer),
+		health:            newHealthChecker(),
+		certificates:      newCertificateStore(store),
+		resolver:          newResolver(),
+		limiter:           newLimiter(),
+		listeners:         make(map[string]*tcpListener),
+		udpListeners:      make(map[string]*udpListener),
+		conns:             make(map[WriteCloser]struct{}),
+		shutdown:          make(chan struct{}),
+		drained:           make(chan struct{}),
 	}
+	// the balancers and health checks of the removed services are dropped
+	notifyResolver(resolver, s.pruneBalancers)
+	return s
 }
 
-// Start starts the server and blocks forever
+// Start starts the server and blocks until ctx is done or the server is shut down
 func (s *Server) Start(ctx context.Context) error {
+	for name, service := range s.Services {
+		if _, err := s.balancer(name, service); err != nil {
+			return fmt.Errorf("invalid service %s: %w", name, err)
+		}
+		for proto, routed := range service.ALPN {
+			if _, err := s.balancer(alpnServiceName(name, proto), routed); err != nil {
+				return fmt.Errorf("invalid service %s: alpn %s: %w", name, proto, err)
+			}
+		}
+	}
+	if err := s.ServerOptions.HTTP.validate(); err != nil {
+		return fmt.Errorf("invalid http configuration: %w", err)
+	}
+	if err := s.ServerOptions.Access.validate(); err != nil {
+		return fmt.Errorf("invalid access configuration: %w", err)
+	}
+	if err := s.ServerOptions.Limits.validate(); err != nil {
+		return fmt.Errorf("invalid limits configuration: %w", err)
+	}
+	for name, ep := range s.ServerOptions.Entrypoints {
+		if err := ep.validate(); err != nil {
+			return fmt.Errorf("invalid entrypoint %s: %w", name, err)
+		}
+		if _, err := s.balancer(entrypointServiceName(name), ep.service()); err != nil {
+			return fmt.Errorf("invalid entrypoint %s: %w", name, err)
+		}
+	}
+	for name, ep := range s.ServerOptions.UDPEntrypoints {
+		if err := ep.validate(); err != nil {
+			return fmt.Errorf("invalid udp entrypoint %s: %w", name, err)
+		}
+		if _, err := s.balancer(entrypointServiceName(name), ep.service()); err != nil {
+			return fmt.Errorf("invalid udp entrypoint %s: %w", name, err)
+		}
+	}
+	acme, err := s.newACMEManager(s.ServerOptions.ACME)
+	if err != nil {
+		return fmt.Errorf("invalid acme configuration: %w", err)
+	}
+	s.acme = acme
+	s.health.start(ctx)
 
-	s.wg.Add(3)
-	go s.listen(ctx, s.ServerOptions.HTTPAddr(), HandlerFunc(s.handleHTTPConnection))
-	go s.listen(ctx, s.ServerOptions.TLSAddr(), HandlerFunc(s.handleConnection))
-	go s.listen(ctx, s.ServerOptions.ClientsAddr(), HandlerFunc(s.handleTCPRouterClientConnection))
+	resolverCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.shutdown:
+			cancel()
+		case <-resolverCtx.Done():
+		}
+	}()
+	go runResolver(resolverCtx, s.services)
 
-	s.wg.Wait()
-	log.Info().Msg("stopping server...")
-	s.listenersMU.Lock()
-	defer s.listenersMU.Unlock()
-	for _, ln := range s.listeners {
-		if ln != nil {
-			if err := ln.Close(); err != nil {
-				log.Error().Err(err).Msg("error closing connection")
-			}
+	for _, l := range s.mainListeners(s.ServerOptions) {
+		if err != nil {
+			break
+		}
+		err = s.listen(ctx, l.id, l.addr, l.pp, l.handler)
+	}
+	for name, ep := range s.ServerOptions.Entrypoints {
+		if err != nil {
+			break
+		}
+		err = s.listen(ctx, entrypointServiceName(name), s.ServerOptions.EntrypointAddr(ep), ep.ProxyProtocol, s.limitConnections(trafficTCP, s.entrypointHandler(name, ep)))
+	}
+	for name, ep := range s.ServerOptions.UDPEntrypoints {
+		if err != nil {
+			break
 		}
+		err = s.listenUDP(ctx, name, ep)
+	}
+	if err != nil {
+		s.closeListeners()
+		s.wg.Wait()
+		return err
+	}
+
+	s.reloadMU.Lock()
+	s.ctx = ctx
+	s.reloadMU.Unlock()
+
+	s.wg.Wait()
+	if s.isShuttingDown() {
+		<-s.drained
+		return nil
 	}
+	log.Info().Msg("stopping server...")
+	s.closeListeners()
 	log.Info().Msg("stopped")
 
 	return nil
 }
 
-func (s *Server) listen(ctx context.Context, addr string, handler Handler) {
-	defer s.wg.Done()
+// mainListener is one of the http, tls and clients listeners every server has
+type mainListener struct {
+	id      string
+	addr    string
+	pp      ProxyProtocolConfig
+	handler Handler
+}
+
+// mainListeners returns the http, tls and clients listeners configured by opts
+func (s *Server) mainListeners(opts ServerOptions) []mainListener {
+	pp := opts.ProxyProtocol
+	return []mainListener{
+		{id: "http", addr: opts.HTTPAddr(), pp: pp.HTTP, handler: s.limitConnections(trafficHTTP, HandlerFunc(s.handleHTTPConnection))},
+		{id: "tls", addr: opts.TLSAddr(), pp: pp.TLS, handler: s.limitConnections(trafficTLS, HandlerFunc(s.handleConnection))},
+		{id: "clients", addr: opts.ClientsAddr(), pp: pp.Clients, handler: HandlerFunc(s.handleTCPRouterClientConnection)},
+	}
+}
+
+// listen binds addr and accepts the connections for handler in the background until ctx is done,
+// the server shuts down or the listener is closed. The listener is registered under id
+func (s *Server) listen(ctx context.Context, id, addr string, ppCfg ProxyProtocolConfig, handler Handler) error {
+	l := &tcpListener{addr: addr, stop: make(chan struct{})}
+	if err := l.setHandler(ppCfg, s.ServerOptions.Timeouts.sniff(), handler); err != nil {
+		return fmt.Errorf("invalid proxy protocol configuration for %s: %w", addr, err)
+	}
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
-		log.Fatal().
-			Err(err).
-			Str("addr", addr).
-			Msg("failed to resolve addr")
+		return fmt.Errorf("failed to resolve addr %s: %w", addr, err)
 	}
-
 	ln, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
-		log.Fatal().
-			Err(err).
-			Str("addr", addr).
-			Msg("failed to start listener")
+		return fmt.Errorf("failed to start listener on %s: %w", addr, err)
 	}
+	l.ln = ln
 
 	s.listenersMU.Lock()
-	s.listeners = append(s.listeners, tcpKeepAliveListener{ln})
+	s.listeners[id] = l
 	s.listenersMU.Unlock()
 
+	s.wg.Add(1)
+	go s.serve(ctx, l)
+	return nil
+}
+
+func (s *Server) serve(ctx context.Context, l *tcpListener) {
+	defer s.wg.Done()
+	defer l.close()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-s.shutdown:
+			return
+		case <-l.stop:
+			return
 
 		default:
-			ln.SetDeadline(time.Now().Add(time.Second))
-			conn, err := ln.AcceptTCP()
+			l.ln.SetDeadline(time.Now().Add(time.Second))
+			conn, err := l.ln.AcceptTCP()
 			if err != nil {
 				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 					continue
 				}
+				if s.isShuttingDown() || l.closed() {
+					return
+				}
 				log.Fatal().Err(err).Msg("Failed to accept connection")
 			}
+			if err := setKeepAlive(conn); err != nil {
+				log.Error().Err(err).Msg("failed to enable keepalive on connection")
+				conn.Close()
+				continue
+			}
 
-			go handler.ServeTCP(conn)
+			untrack := s.trackConnection(conn)
+			handler := l.handler.Load().(Handler)
+			go func() {
+				defer untrack()
+				handler.ServeTCP(conn)
+			}()
 		}
 	}
 }
 
-func (s *Server) getHost(host string) (Service, error) {
-	service := Service{}
-
-	key := fmt.Sprintf("tcprouter/service/%s", host)
-	servicePair, err := s.DbStore.Get(key, nil)
-	if err != nil {
-		return service, fmt.Errorf("host not found at key %s: %v", key, err)
-	}
-
-	err = json.Unmarshal(servicePair.Value, &service)
-	if err != nil {
-		return service, fmt.Errorf("invalid service content")
-	}
-
-	log.Debug().
-		Str("key", key).
-		Str("service", fmt.Sprintf("%v", service)).
-		Msg("service found")
-	return service, nil
-}
-
 func (s *Server) handleTCPRouterClientConnection(conn WriteCloser) {
 	session, err := yamux.Server(conn, nil)
 	if err != nil {
@@ -180,133 +359,418 @@ func (s *Server) handleTCPRouterClientConnection(conn WriteCloser) {
 		conn.Close()
 		return
 	}
+	stream.SetReadDeadline(time.Now().Add(clientHandshakeTimeout))
+	features, err := readFeatures(stream)
+	if err != nil {
+		log.Error().Err(err).Msg("handshake failed")
+		conn.Close()
+		return
+	}
+	tunnel := &tunnelSession{Session: session, streamHeaders: features&featureStreamHeaders != 0}
+	if tunnel.streamHeaders {
+		if err := writeFeatures(stream, featureStreamHeaders); err != nil {
+			log.Error().Err(err).Msg("handshake failed")
+			conn.Close()
+			return
+		}
+	}
 	log.Info().
 		Str("remote addr", conn.RemoteAddr().String()).
+		Bool("stream headers", tunnel.streamHeaders).
 		Msg("handshake done... adding to active connections")
 
-	s.activeConnections[string(hs.Secret[:])] = session
+	secret := string(hs.Secret[:])
+	s.addSession(secret, tunnel)
+	go func() {
+		<-session.CloseChan()
+		s.removeSession(secret, tunnel)
+	}()
 }
 
-func (s *Server) handleConnection(conn WriteCloser) {
-	br := bufio.NewReader(conn)
-	serverName, isTLS, peeked := clientHelloServerName(br)
-	log.Info().
-		Str("server name", serverName).
-		Bool("is TLS", isTLS).
-		Msg("connection analyzed")
+// tunnelSession is a session opened by a tcp router client
+type tunnelSession struct {
+	*yamux.Session
+	// streamHeaders is set when the client asked for a streamHeader at the beginning of the streams.
+	// Older clients don't know about them and only receive the http and tls traffic
+	streamHeaders bool
+}
 
-	if err := s.handleService(conn, serverName, peeked, isTLS); err != nil {
-		log.Error().
-			Str("server name", serverName).
-			Err(err).
-			Msg("error forwarding traffic")
-	}
+func (s *Server) addSession(secret string, session *tunnelSession) {
+	s.activeConnectionsMU.Lock()
+	defer s.activeConnectionsMU.Unlock()
+
+	s.activeConnections[secret] = append(s.activeConnections[secret], session)
 }
 
-func (s *Server) handleHTTPConnection(conn WriteCloser) {
-	br := bufio.NewReader(conn)
-	peeked := ""
-	host := ""
-	for {
-		line, err := br.ReadString('\n')
-		if err != nil {
-			log.Error().Err(err).Msg("failed to decode HTTP header")
-			return
-		}
-		peeked = peeked + line
-		if strings.HasPrefix(line, "Host:") {
-			host = strings.Trim(line[6:], " \n\r")
-			if strings.Contains(host, ":") {
-				host, _, err = net.SplitHostPort(host)
-				if err != nil {
-					log.Error().
-						Err(err).
-						Str("server name", host).
-						Msg("failed to parse split host port from server name")
-					return
-				}
-			}
-		}
-		if strings.Trim(line, " \n\r") == "" {
+func (s *Server) removeSession(secret string, session *tunnelSession) {
+	s.activeConnectionsMU.Lock()
+	defer s.activeConnectionsMU.Unlock()
+
+	sessions := s.activeConnections[secret]
+	for i, sess := range sessions {
+		if sess == session {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
 			break
 		}
+	}
+	if len(sessions) == 0 {
+		delete(s.activeConnections, secret)
+	} else {
+		s.activeConnections[secret] = sessions
+	}
+}
+
+// sessions returns the tunnel sessions opened by the clients using secret, the most recent first
+func (s *Server) sessions(secret string) []*tunnelSession {
+	s.activeConnectionsMU.Lock()
+	defer s.activeConnectionsMU.Unlock()
 
+	sessions := s.activeConnections[secret]
+	result := make([]*tunnelSession, len(sessions))
+	for i, session := range sessions {
+		result[len(sessions)-1-i] = session
 	}
-	if host == "" {
-		log.Error().Msg("could not find host in HTTP header")
+	return result
+}
+
+func (s *Server) handleConnection(conn WriteCloser) {
+	br := bufio.NewReader(conn)
+	deadline := time.Now().Add(s.ServerOptions.Timeouts.sniff())
+	conn.SetReadDeadline(deadline)
+	hello, isTLS, peeked := peekClientHello(br)
+	conn.SetReadDeadline(time.Time{})
+	if peeked == "" || !time.Now().Before(deadline) {
+		log.Warn().
+			Str("remote addr", conn.RemoteAddr().String()).
+			Msg("nothing to route received in time")
 		conn.Close()
 		return
 	}
-	peeked += getPeeked(br)
-	log.Info().Msgf("Host found: '%s'", host)
-	if err := s.handleService(conn, host, peeked, false); err != nil {
+	log.Info().
+		Str("server name", hello.serverName).
+		Strs("alpn", hello.protocols).
+		Str("remote addr", conn.RemoteAddr().String()).
+		Bool("is TLS", isTLS).
+		Msg("connection analyzed")
+
+	if err := s.handleService(conn, hello.serverName, peeked, isTLS, hello.protocols); err != nil {
 		log.Error().
-			Str("server name", host).
+			Str("server name", hello.serverName).
 			Err(err).
 			Msg("error forwarding traffic")
 	}
 }
 
-func (s *Server) handleService(incoming WriteCloser, serverName, peeked string, isTLS bool) error {
-	serverName = strings.ToLower(serverName)
-	service, exists := s.Services[serverName]
-	if !exists {
-		log.Info().Msg("not found in file config, try to load it from db backend")
-		var err error
-		service, err = s.getHost(serverName)
-		exists = err == nil
+// lookupService finds the service matching serverName and returns the name it is registered under.
+// Exact matches are preferred over wildcard ones and the most specific wildcard wins.
+// For the same name the order of the resolvers decides, e.g. the static configuration
+// has precedence over the db backend
+func (s *Server) lookupService(serverName string) (string, Service, bool) {
+	for _, name := range hostCandidates(serverName) {
+		if service, ok := s.services.Resolve(name); ok {
+			return name, service, true
+		}
 	}
 
+	service, ok := s.services.Resolve(catchAllService)
+	return catchAllService, service, ok
+}
+
+// handleService forwards incoming to the service serving serverName. protocols are the
+// ALPN protocols offered by TLS clients and can select a different route of the service
+func (s *Server) handleService(incoming WriteCloser, serverName, peeked string, isTLS bool, protocols []string) error {
+	serverName = normalizeHost(serverName)
+	name, service, exists := s.lookupService(serverName)
 	if !exists {
-		service, exists = s.Services["CATCH_ALL"]
-		if !exists {
-			incoming.Close()
-			return fmt.Errorf("service doesn't exist: %v and no 'CATCH_ALL' service for request", service)
+		incoming.Close()
+		return fmt.Errorf("service doesn't exist: %s and no '%s' service for request", serverName, catchAllService)
+	}
+	// the limits of the service apply to its routes as well
+	parentName, parentLimits := name, service.Limits
+	if routed, proto, ok := service.alpnRoute(protocols); ok {
+		log.Info().
+			Str("server name", serverName).
+			Str("alpn", proto).
+			Msg("alpn route selected")
+		name, service = alpnServiceName(name, proto), routed
+	}
+
+	if err := s.checkAccess(service, incoming.RemoteAddr()); err != nil {
+		logAccessDenied(err, serverName, incoming.RemoteAddr())
+		if isTLS {
+			incoming.Write(tlsAccessDeniedAlert)
+		}
+		incoming.Close()
+		return nil
+	}
+
+	limited, err := s.limiter.acquireService(parentName, parentLimits)
+	if err != nil {
+		s.reject(incoming, trafficKindOf(isTLS, peeked), err)
+		return nil
+	}
+	defer limited()
+	if name != parentName {
+		routeLimited, err := s.limiter.acquireService(name, service.Limits)
+		if err != nil {
+			s.reject(incoming, trafficKindOf(isTLS, peeked), err)
+			return nil
 		}
+		defer routeLimited()
 	}
 
 	log.Info().Str("service", fmt.Sprintf("%v", service)).Msg("service found")
 
 	incoming = GetConn(incoming, peeked)
-	var (
-		outgoing WriteCloser
-		err      error
-	)
-
-	if service.ClientSecret != "" {
-		// retrive an active connection and forward traffic on it
-		activeConn, ok := s.activeConnections[service.ClientSecret]
-		if !ok {
+	reencrypt := false
+	if isTLS && service.TerminateTLS {
+		conn, err := s.terminateTLS(incoming, serverName, service)
+		if err == errACMEChallenge {
+			return nil
+		} else if err != nil {
 			incoming.Close()
-			return fmt.Errorf("no active connection for service %s", serverName)
+			return err
 		}
+		// from now on the traffic is plain, unless it is encrypted again for the backend
+		incoming = conn
+		reencrypt = service.UpstreamTLS.Enabled
+		isTLS = reencrypt
+	}
+
+	service, outgoing, release, err := s.connectWithFallback(name, service, serverName, incoming.RemoteAddr(), backendPort(isTLS))
+	if err != nil {
+		incoming.Close()
+		return err
+	}
+	defer release()
 
-		log.Info().Msgf("open new stream to client %s", serverName)
-		stream, err := activeConn.OpenStream()
+	// the PROXY protocol header goes in front of the TLS handshake with the backend
+	if err := sendProxyHeader(incoming, outgoing, service, serverName); err != nil {
+		incoming.Close()
+		outgoing.Close()
+		return err
+	}
+	if reencrypt {
+		conn, err := s.upstreamTLS(outgoing, serverName, service)
 		if err != nil {
+			outgoing.Close()
 			incoming.Close()
-			return fmt.Errorf("failed to open stream: %w", err)
+			return err
 		}
-		outgoing = WrapConn(stream)
+		outgoing = conn
+	}
 
-	} else {
-		// Dial target server and forward traffic on it
-		remotePort := service.HTTPPort
-		if isTLS {
-			remotePort = service.TLSPort
+	forwardConnection(incoming, outgoing, s.timeouts(service))
+	return nil
+}
+
+// connectWithFallback connects to service and falls back to the CATCH_ALL service when the health
+// checks report all the direct backends of service down. The connections falling back are subject
+// to the access lists and limits of CATCH_ALL. It returns the service actually connected
+func (s *Server) connectWithFallback(name string, service Service, serverName string, src net.Addr, port func(Backend) int) (Service, WriteCloser, func(), error) {
+	outgoing, release, err := s.connectService(name, service, streamHeader{kind: streamTunnel}, src, port)
+	if !errors.Is(err, errNoBackend) || name == catchAllService || !s.health.allDown(service) {
+		return service, outgoing, release, err
+	}
+	catchAll, ok := s.services.Resolve(catchAllService)
+	if !ok {
+		return service, outgoing, release, err
+	}
+
+	if err := s.checkAccess(catchAll, src); err != nil {
+		return service, nil, nil, err
+	}
+	limited, err := s.limiter.acquireService(catchAllService, catchAll.Limits)
+	if err != nil {
+		return service, nil, nil, err
+	}
+	log.Warn().
+		Str("server name", serverName).
+		Msgf("no healthy backend, falling back to '%s' service", catchAllService)
+	outgoing, release, err = s.connectService(catchAllService, catchAll, streamHeader{kind: streamTunnel}, src, port)
+	if err != nil {
+		limited()
+		return catchAll, nil, nil, err
+	}
+	return catchAll, outgoing, func() {
+		release()
+		limited()
+	}, nil
+}
+
+// backendPort returns a function selecting the port of a backend
+// matching the kind of traffic received
+func backendPort(isTLS bool) func(Backend) int {
+	if isTLS {
+		return func(b Backend) int { return b.TLSPort }
+	}
+	return func(b Backend) int { return b.HTTPPort }
+}
+
+// proxy sends the PROXY protocol header if the service requires it, then forwards
+// traffic between incoming and outgoing until one of them is closed or times out
+func proxy(incoming, outgoing WriteCloser, service Service, serverName string, timeouts connTimeouts) error {
+	if err := sendProxyHeader(incoming, outgoing, service, serverName); err != nil {
+		incoming.Close()
+		outgoing.Close()
+		return err
+	}
+
+	forwardConnection(incoming, outgoing, timeouts)
+	return nil
+}
+
+// sendProxyHeader writes the PROXY protocol header describing incoming on outgoing
+// if the service requires it
+func sendProxyHeader(incoming, outgoing WriteCloser, service Service, serverName string) error {
+	if service.ProxyProtocol == 0 {
+		return nil
+	}
+	hdr := ProxyHeader{
+		Version:     service.ProxyProtocol,
+		Source:      incoming.RemoteAddr(),
+		Destination: incoming.LocalAddr(),
+		Authority:   serverName,
+	}
+	if err := hdr.Write(outgoing); err != nil {
+		return fmt.Errorf("failed to send proxy protocol header: %w", err)
+	}
+	return nil
+}
+
+// connectService opens a connection to service, either a stream on the tunnel
+// of the client, starting with stream, or a connection to one of its backends. Failed attempts are retried
+// on another tunnel session or another backend up to service.Retries times.
+// Nothing has been read from the incoming connection yet, so the peeked bytes are
+// replayed on whichever connection succeeds. release must be called once the connection is over
+func (s *Server) connectService(name string, service Service, stream streamHeader, src net.Addr, port func(Backend) int) (outgoing WriteCloser, release func(), err error) {
+	attempts := service.Retries + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	triedSessions := make(map[*tunnelSession]bool)
+	triedBackends := make(map[Backend]bool)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if service.ClientSecret != "" {
+			outgoing, release, err = s.openStream(name, service, stream, triedSessions)
+		} else {
+			outgoing, release, err = s.dialBackend(name, service, src, port, triedBackends)
 		}
-		outgoing, err = net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(service.Addr), Port: remotePort})
-		if err != nil {
-			incoming.Close()
-			return fmt.Errorf("error while connection to service: %v", err)
+		if err == nil || errors.Is(err, errNoBackend) {
+			return outgoing, release, err
+		}
+
+		if attempt < attempts {
+			log.Warn().
+				Err(err).
+				Str("service", name).
+				Int("attempt", attempt).
+				Msg("failed to connect to service, retrying")
 		}
 	}
 
-	forwardConnection(incoming, outgoing)
-	return nil
+	return nil, nil, err
+}
+
+// openStream opens a new stream on one of the tunnel sessions of the client of service
+// and writes hdr on it if the session negotiated stream headers. Sessions already tried are
+// skipped, as well as the sessions without stream headers for the traffic of entrypoints
+func (s *Server) openStream(name string, service Service, hdr streamHeader, tried map[*tunnelSession]bool) (WriteCloser, func(), error) {
+	var session *tunnelSession
+	for _, sess := range s.sessions(service.ClientSecret) {
+		if !tried[sess] && !sess.IsClosed() && (sess.streamHeaders || hdr.kind == streamTunnel) {
+			session = sess
+			break
+		}
+	}
+	if session == nil {
+		if len(tried) > 0 {
+			return nil, nil, fmt.Errorf("no other active connection for service %s: %w", name, errNoBackend)
+		}
+		return nil, nil, fmt.Errorf("no active connection for service %s: %w", name, errNoBackend)
+	}
+	tried[session] = true
+
+	log.Info().Msgf("open new stream to client %s", name)
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	if session.streamHeaders {
+		hdr.proxyHeader = service.ProxyProtocol != 0
+		if err := hdr.Write(stream); err != nil {
+			stream.Close()
+			return nil, nil, fmt.Errorf("failed to write stream header: %w", err)
+		}
+	}
+	return WrapConn(stream), func() {}, nil
+}
+
+// dialBackend chooses a healthy backend of service, preferring the ones not tried yet, and dials it
+func (s *Server) dialBackend(name string, service Service, src net.Addr, port func(Backend) int, tried map[Backend]bool) (WriteCloser, func(), error) {
+	lb, err := s.balancer(name, service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	healthy := func(b Backend) bool {
+		return s.health.isUp(service, b)
+	}
+	i, ok := lb.pick(src, func(b Backend) bool {
+		return !tried[b] && healthy(b)
+	})
+	if !ok && len(tried) > 0 {
+		// all the backends have been tried, try them again
+		i, ok = lb.pick(src, healthy)
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("service %s: %w", name, errNoBackend)
+	}
+
+	backend := lb.backends[i]
+	tried[backend] = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), service.dialTimeout())
+	defer cancel()
+	conn, err := s.dialAddr(ctx, backend.Addr, port(backend))
+	if err != nil {
+		lb.release(i, true)
+		return nil, nil, fmt.Errorf("error while connection to service: %w", err)
+	}
+
+	// the backend is known to work once it answered, connections reset
+	// before that are reported as failed when they are over
+	var once sync.Once
+	report := func(failed bool) {
+		once.Do(func() { lb.report(i, failed) })
+	}
+	mc := &monitoredConn{WriteCloser: conn, received: func() { report(false) }}
+	return mc, func() {
+		report(mc.failed())
+		lb.done(i)
+	}, nil
+}
+
+// dialAddr connects to the backend address addr, which is either a unix socket,
+// an IP address or a hostname
+func (s *Server) dialAddr(ctx context.Context, addr string, port int) (WriteCloser, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		return dialUnix(ctx, path)
+	}
+
+	ips, err := s.resolver.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialHappyEyeballs(ctx, &net.Dialer{}, ips, port)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
 }
 
-func forwardConnection(local, remote WriteCloser) {
+func forwardConnection(local, remote WriteCloser, timeouts connTimeouts) {
 	log.Info().
 		Str("remote", remote.RemoteAddr().String()).
 		Str("local", local.RemoteAddr().String()).
@@ -318,11 +782,13 @@ func forwardConnection(local, remote WriteCloser) {
 		remote.Close()
 	}()
 
+	local, remote, watchdog := timeouts.watch(local, remote)
+	defer watchdog.stop()
 	go forward(local, remote, cErr)
 	go forward(remote, local, cErr)
 
 	err := <-cErr
-	if err != nil {
+	if err != nil && !watchdog.hasExpired() {
 		log.Error().
 			Str("remote", remote.RemoteAddr().String()).
 			Str("local", local.RemoteAddr().String()).
@@ -333,23 +799,10 @@ func forwardConnection(local, remote WriteCloser) {
 	<-cErr
 }
 
-type tcpKeepAliveListener struct {
-	*net.TCPListener
-}
-
-func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
-	tc, err := ln.AcceptTCP()
-	if err != nil {
-		return nil, err
-	}
-
-	if err = tc.SetKeepAlive(true); err != nil {
-		return nil, err
+// setKeepAlive enables the TCP keepalive on the accepted connections so dead peers are detected
+func setKeepAlive(conn *net.TCPConn) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
 	}
-
-	if err = tc.SetKeepAlivePeriod(3 * time.Minute); err != nil {
-		return nil, err
-	}
-
-	return tc, nil
+	return conn.SetKeepAlivePeriod(3 * time.Minute)
 }
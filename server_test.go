@@ -0,0 +1,70 @@
+package tcprouter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+// waitListening waits until addr accepts connections
+func waitListening(t *testing.T, addr string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s is not listening", addr)
+}
+
+func TestConnectServiceRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	service := Service{
+		Backends: []Backend{
+			{Addr: "127.0.0.1", HTTPPort: closedPort(t)},
+			{Addr: "127.0.0.1", HTTPPort: l.Addr().(*net.TCPAddr).Port},
+		},
+	}
+	// a new server starts balancing on the first backend, which is closed
+	_, _, err = NewServer(ServerOptions{}, nil, nil).connectService("example.com", service, streamHeader{kind: streamTunnel}, nil, backendPort(false))
+	require.Error(t, err)
+
+	// the failed attempt on the closed backend is retried on the other one
+	service.Retries = 1
+	s := NewServer(ServerOptions{}, nil, nil)
+	conn, release, err := s.connectService("example.com", service, streamHeader{kind: streamTunnel}, nil, backendPort(false))
+	require.NoError(t, err)
+	assert.Equal(t, conn.RemoteAddr().String(), l.Addr().String())
+	conn.Close()
+	release()
+
+	service.ClientSecret = "secret"
+	_, _, err = s.connectService("example.com", service, streamHeader{kind: streamTunnel}, nil, backendPort(false))
+	require.Error(t, err)
+}
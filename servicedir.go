@@ -0,0 +1,244 @@
+package tcprouter
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// editors and tools write files in several steps, changes are applied once
+// the directory has been quiet for this long
+const serviceDirDebounce = 100 * time.Millisecond
+
+// isServiceFile returns true if name has the extension of a supported service file format
+func isServiceFile(name string) bool {
+	if strings.HasPrefix(filepath.Base(name), ".") {
+		// hidden and temporary files of editors
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".toml", ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// loadedFile is the last valid content of a service file
+type loadedFile struct {
+	// sum is the hash of the content last read, valid or not
+	sum      [sha256.Size]byte
+	services map[string]Service
+}
+
+// DirectoryResolver resolves the services defined in the TOML, JSON and YAML files of a
+// directory, e.g. one file per tenant. The directory is watched and the services are swapped
+// as soon as a file is added, modified or removed. A file that can't be loaded is logged
+// and the services it defined before keep being served
+type DirectoryResolver struct {
+	dir     string
+	refresh time.Duration
+
+	mu       sync.RWMutex
+	services map[string]Service
+	// changed is called after the services are swapped
+	changed func()
+	// files are only used by the goroutine scanning the directory
+	files map[string]loadedFile
+}
+
+// NewDirectoryResolver creates a resolver for the service files of dir and loads them.
+// When the directory can't be watched it is scanned every refresh interval, default to 10 seconds
+func NewDirectoryResolver(dir string, refresh time.Duration) *DirectoryResolver {
+	if refresh <= 0 {
+		refresh = defaultServiceRefresh
+	}
+	r := &DirectoryResolver{
+		dir:      dir,
+		refresh:  refresh,
+		services: make(map[string]Service),
+		files:    make(map[string]loadedFile),
+	}
+	r.scan()
+	return r
+}
+
+// Resolve implements ServiceResolver
+func (r *DirectoryResolver) Resolve(name string) (Service, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	service, ok := r.services[name]
+	return service, ok
+}
+
+// scan loads the files of the directory whose content changed since the last scan and swaps
+// the services. Contents are compared rather than modification times, which miss quick rewrites
+// and don't follow symlinks, e.g. the files of a Kubernetes ConfigMap
+func (r *DirectoryResolver) scan() {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		log.Error().Err(err).Str("dir", r.dir).Msg("failed to read services directory, keeping the previous services")
+		return
+	}
+
+	present := make(map[string]bool)
+	changed := false
+	for _, entry := range entries {
+		if !isServiceFile(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(r.dir, entry.Name())
+		// symlinks are followed
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		previous, ok := r.files[path]
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error().Err(err).Str("file", path).Msg("failed to read service file, keeping its previous services")
+			if ok {
+				present[path] = true
+			}
+			continue
+		}
+		present[path] = true
+
+		sum := sha256.Sum256(data)
+		if ok && previous.sum == sum {
+			continue
+		}
+		// the file is not loaded again until its content changes
+		previous.sum = sum
+		services, err := decodeServiceFile(path, data)
+		if err != nil {
+			log.Error().Err(err).Str("file", path).Msg("failed to load service file, keeping its previous services")
+			r.files[path] = previous
+			continue
+		}
+		log.Info().Str("file", path).Int("services", len(services)).Msg("service file loaded")
+		r.files[path] = loadedFile{sum: sum, services: services}
+		changed = true
+	}
+	for path := range r.files {
+		if !present[path] {
+			log.Info().Str("file", path).Msg("service file removed")
+			delete(r.files, path)
+			changed = true
+		}
+	}
+
+	if changed {
+		r.swap()
+	}
+}
+
+// swap merges the services of all the files and replaces the served ones.
+// A name defined in several files is served from the first file in lexical order
+func (r *DirectoryResolver) swap() {
+	paths := make([]string, 0, len(r.files))
+	for path := range r.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	services := make(map[string]Service)
+	owners := make(map[string]string)
+	for _, path := range paths {
+		for name, service := range r.files[path].services {
+			if owner, ok := owners[name]; ok {
+				log.Warn().
+					Str("service", name).
+					Str("file", path).
+					Str("defined in", owner).
+					Msg("service defined in several files, ignoring")
+				continue
+			}
+			services[name] = service
+			owners[name] = path
+		}
+	}
+
+	r.mu.Lock()
+	r.services = services
+	changed := r.changed
+	r.mu.Unlock()
+
+	if changed != nil {
+		changed()
+	}
+}
+
+// OnChange sets the function called after the services of the directory change
+func (r *DirectoryResolver) OnChange(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changed = fn
+}
+
+// Run watches the directory and applies the changes of its files until ctx is done
+func (r *DirectoryResolver) Run(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(r.dir)
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("dir", r.dir).Msg("failed to watch services directory, polling for changes")
+		r.poll(ctx)
+		return
+	}
+	defer watcher.Close()
+
+	// the directory may have changed before the watch started
+	r.scan()
+
+	debounce := time.NewTimer(serviceDirDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// any event triggers a scan, not only the ones of service files, e.g. the swap
+			// of the hidden symlink the files of a Kubernetes ConfigMap point to
+			log.Debug().Str("file", event.Name).Msg("services directory changed")
+			debounce.Reset(serviceDirDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been lost, look at every file again
+			log.Error().Err(err).Str("dir", r.dir).Msg("services directory watch error")
+			debounce.Reset(serviceDirDebounce)
+		case <-debounce.C:
+			r.scan()
+		}
+	}
+}
+
+func (r *DirectoryResolver) poll(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.scan()
+		}
+	}
+}
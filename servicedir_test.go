@@ -0,0 +1,167 @@
+package tcprouter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectoryResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	write("tenant1.toml", `
+[services."a.com"]
+addr = "127.0.0.1"
+tlsport = 443
+`)
+	write("tenant2.yaml", `
+services:
+  b.com:
+    addr: 127.0.0.2
+    httpport: 8080
+    healthcheck:
+      type: tcp
+  a.com:
+    addr: 127.0.0.9
+`)
+	write("notes.txt", "not a service file")
+
+	r := NewDirectoryResolver(dir, time.Minute)
+	service, ok := r.Resolve("a.com")
+	assert.Equal(t, ok, true)
+	// the first file defining a name wins
+	assert.Equal(t, service.Addr, "127.0.0.1")
+	service, ok = r.Resolve("b.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.HTTPPort, 8080)
+	assert.Equal(t, service.HealthCheck.Type, "tcp")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	// let the watch start
+	time.Sleep(100 * time.Millisecond)
+
+	eventually := func(name string, want bool) {
+		for i := 0; i < 50; i++ {
+			if _, ok := r.Resolve(name); ok == want {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("service %s resolved: %v, want %v", name, !want, want)
+	}
+
+	write("tenant3.json", `{"services": {"c.com": {"addr": "127.0.0.3"}}}`)
+	eventually("c.com", true)
+
+	// an invalid file keeps its previous services while the others are updated
+	write("tenant1.toml", `[services."a.com"`)
+	write("tenant3.json", `{"services": {"d.com": {"addr": "127.0.0.4"}}}`)
+	eventually("d.com", true)
+	eventually("c.com", false)
+	service, ok = r.Resolve("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.Addr, "127.0.0.1")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "tenant2.yaml")))
+	eventually("b.com", false)
+}
+
+func TestDirectoryResolverRemovedService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tenant.toml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+[services."a.com"]
+addr = "127.0.0.1"
+tlsport = 443
+[services."a.com".healthcheck]
+type = "tcp"
+`), 0600))
+
+	s := NewServer(ServerOptions{ServicesDir: dir}, nil, nil)
+	resolver := s.services.(ChainResolver)[1].(*DirectoryResolver)
+	_, service, ok := s.lookupService("a.com")
+	require.True(t, ok)
+	_, err = s.balancer("a.com", service)
+	require.NoError(t, err)
+
+	// the health checks stop with the file defining the service
+	require.NoError(t, os.Remove(path))
+	resolver.scan()
+	_, ok = s.balancers["a.com"]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, len(s.health.targets), 0)
+}
+
+func TestDirectoryResolverContentChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// files of a Kubernetes ConfigMap are symlinks through a hidden ..data symlink
+	version := func(name, content string) {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, "tenant.toml"), []byte(content), 0600))
+		tmp := filepath.Join(dir, "..data_tmp")
+		require.NoError(t, os.Symlink(name, tmp))
+		require.NoError(t, os.Rename(tmp, filepath.Join(dir, "..data")))
+	}
+	version("..v1", `[services."a.com"]
+addr = "127.0.0.1"
+`)
+	require.NoError(t, os.Symlink(filepath.Join("..data", "tenant.toml"), filepath.Join(dir, "tenant.toml")))
+	plain := filepath.Join(dir, "plain.toml")
+	require.NoError(t, ioutil.WriteFile(plain, []byte(`[services."b.com"]
+addr = "127.0.0.1"
+`), 0600))
+	modTime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(plain, modTime, modTime))
+
+	r := NewDirectoryResolver(dir, time.Minute)
+	_, ok := r.Resolve("a.com")
+	assert.Equal(t, ok, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	eventually := func(name string, want bool) {
+		for i := 0; i < 50; i++ {
+			if _, ok := r.Resolve(name); ok == want {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("service %s resolved: %v, want %v", name, !want, want)
+	}
+
+	// the symlink swap only touches hidden names
+	version("..v2", `[services."c.com"]
+addr = "127.0.0.1"
+`)
+	eventually("c.com", true)
+	eventually("a.com", false)
+
+	// a rewrite keeping the modification time is applied
+	require.NoError(t, ioutil.WriteFile(plain, []byte(`[services."d.com"]
+addr = "127.0.0.1"
+`), 0600))
+	require.NoError(t, os.Chtimes(plain, modTime, modTime))
+	eventually("d.com", true)
+	eventually("b.com", false)
+}
@@ -0,0 +1,268 @@
+package tcprouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/abronan/valkeyrie/store"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// ServiceResolver finds the services the router forwards traffic to.
+// Resolvers that keep their services up to date in the background can also implement
+// Run(ctx context.Context), which is called by Server.Start and must return once ctx is done.
+// Resolvers whose services change at runtime can implement OnChange(fn func()) and call fn
+// after each change, so the server drops the balancers and health checks of the removed services
+type ServiceResolver interface {
+	// Resolve returns the service registered under name. Names are lower case
+	// and wildcard services are registered under names like *.example.com
+	Resolve(name string) (Service, bool)
+}
+
+// serviceRunner is implemented by the resolvers refreshing their services in the background
+type serviceRunner interface {
+	Run(ctx context.Context)
+}
+
+// serviceNotifier is implemented by the resolvers whose services change at runtime,
+// fn is called after each change
+type serviceNotifier interface {
+	OnChange(fn func())
+}
+
+// notifyResolver calls fn after each change of the services of r if they can change
+func notifyResolver(r ServiceResolver, fn func()) {
+	if notifier, ok := r.(serviceNotifier); ok {
+		notifier.OnChange(fn)
+	}
+}
+
+// runResolver runs r until ctx is done if it refreshes its services in the background
+func runResolver(ctx context.Context, r ServiceResolver) {
+	if runner, ok := r.(serviceRunner); ok {
+		runner.Run(ctx)
+	}
+}
+
+// StaticResolver resolves the services of a fixed map
+type StaticResolver map[string]Service
+
+// NewStaticResolver creates a resolver for services, their names are normalized
+func NewStaticResolver(services map[string]Service) StaticResolver {
+	return StaticResolver(normalizeServices(services))
+}
+
+// Resolve implements ServiceResolver
+func (r StaticResolver) Resolve(name string) (Service, bool) {
+	service, ok := r[name]
+	return service, ok
+}
+
+// KVResolver resolves the services stored in a valkeyrie store under tcprouter/service/<name>.
+// The services are kept in memory and refreshed every refresh interval, and as soon as they
+// change for the stores that can watch a prefix
+type KVResolver struct {
+	table *serviceTable
+}
+
+// NewKVResolver creates a resolver for the services of kv, refresh defaults to 10 seconds
+func NewKVResolver(kv store.Store, refresh time.Duration) *KVResolver {
+	return &KVResolver{table: newServiceTable(kv, refresh)}
+}
+
+// Resolve implements ServiceResolver
+func (r *KVResolver) Resolve(name string) (Service, bool) {
+	return r.table.lookup(name)
+}
+
+// OnChange sets the function called after the services of the store change
+func (r *KVResolver) OnChange(fn func()) {
+	r.table.notify(fn)
+}
+
+// Run loads the services of the store and keeps them up to date until ctx is done
+func (r *KVResolver) Run(ctx context.Context) {
+	if err := r.table.load(); err != nil {
+		log.Error().Err(err).Msg("failed to load services from db backend")
+	}
+	r.table.run(ctx)
+}
+
+// ChainResolver resolves names with the first of its resolvers knowing them
+type ChainResolver []ServiceResolver
+
+// Resolve implements ServiceResolver
+func (r ChainResolver) Resolve(name string) (Service, bool) {
+	for _, resolver := range r {
+		if service, ok := resolver.Resolve(name); ok {
+			return service, true
+		}
+	}
+	return Service{}, false
+}
+
+// OnChange sets the function called after the services of any resolver of the chain change
+func (r ChainResolver) OnChange(fn func()) {
+	for _, resolver := range r {
+		notifyResolver(resolver, fn)
+	}
+}
+
+// Run runs the resolvers of the chain until ctx is done
+func (r ChainResolver) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, resolver := range r {
+		if runner, ok := resolver.(serviceRunner); ok {
+			wg.Add(1)
+			go func(runner serviceRunner) {
+				defer wg.Done()
+				runner.Run(ctx)
+			}(runner)
+		}
+	}
+	wg.Wait()
+}
+
+// serviceFile is the content of the files defining services
+type serviceFile struct {
+	Services map[string]Service `toml:"services" json:"services" yaml:"services"`
+}
+
+// parseServiceFile reads the services defined in the file at path, its format
+// is selected by its extension
+func parseServiceFile(path string) (map[string]Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeServiceFile(path, data)
+}
+
+// decodeServiceFile decodes data, the content of the service file at path
+func decodeServiceFile(path string, data []byte) (map[string]Service, error) {
+	var content serviceFile
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		err = toml.Unmarshal(data, &content)
+	case ".json":
+		err = json.Unmarshal(data, &content)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &content)
+	default:
+		return nil, fmt.Errorf("unsupported service file format '%s'", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+
+	for name, service := range content.Services {
+		if err := service.validate(); err != nil {
+			return nil, fmt.Errorf("invalid service %s: %w", name, err)
+		}
+	}
+	return normalizeServices(content.Services), nil
+}
+
+// FileResolver resolves the services defined in a TOML, JSON or YAML file, e.g.
+//
+//	[services."example.com"]
+//	addr = "192.168.1.10"
+//	tlsport = 443
+//
+// The file is read again when it is modified. When it is invalid, the error is logged
+// and the services previously loaded are kept
+type FileResolver struct {
+	path    string
+	refresh time.Duration
+
+	mu       sync.RWMutex
+	services map[string]Service
+	modTime  time.Time
+	// changed is called after the services are reloaded
+	changed func()
+}
+
+// NewFileResolver creates a resolver for the services of the file at path, which is
+// checked for modifications every refresh interval, default to 10 seconds
+func NewFileResolver(path string, refresh time.Duration) (*FileResolver, error) {
+	if refresh <= 0 {
+		refresh = defaultServiceRefresh
+	}
+	r := &FileResolver{path: path, refresh: refresh}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Resolve implements ServiceResolver
+func (r *FileResolver) Resolve(name string) (Service, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	service, ok := r.services[name]
+	return service, ok
+}
+
+// reload reads the file again if it was modified since it was last loaded
+func (r *FileResolver) reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	unchanged := r.services != nil && info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	services, err := parseServiceFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.services = services
+	r.modTime = info.ModTime()
+	changed := r.changed
+	r.mu.Unlock()
+	log.Info().Str("file", r.path).Int("services", len(services)).Msg("services loaded")
+
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
+
+// OnChange sets the function called after the file is reloaded
+func (r *FileResolver) OnChange(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changed = fn
+}
+
+// Run checks the file for modifications until ctx is done
+func (r *FileResolver) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				log.Error().Err(err).Str("file", r.path).Msg("failed to reload services, keeping the previous ones")
+			}
+		}
+	}
+}
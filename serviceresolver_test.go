@@ -0,0 +1,180 @@
+package tcprouter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resolverFunc adapts a function to the ServiceResolver interface
+type resolverFunc func(name string) (Service, bool)
+
+func (f resolverFunc) Resolve(name string) (Service, bool) { return f(name) }
+
+func TestChainResolver(t *testing.T) {
+	chain := ChainResolver{
+		NewStaticResolver(map[string]Service{"A.com": {Addr: "static"}}),
+		resolverFunc(func(name string) (Service, bool) {
+			return Service{Addr: "custom " + name}, name != "unknown.com"
+		}),
+	}
+
+	service, ok := chain.Resolve("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.Addr, "static")
+	service, ok = chain.Resolve("b.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.Addr, "custom b.com")
+	_, ok = chain.Resolve("unknown.com")
+	assert.Equal(t, ok, false)
+}
+
+func TestServerWithResolver(t *testing.T) {
+	s := NewServerWithResolver(ServerOptions{}, nil, resolverFunc(func(name string) (Service, bool) {
+		return Service{Addr: "10.0.0.1"}, name == "*.example.com"
+	}))
+
+	name, service, ok := s.lookupService("www.example.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, name, "*.example.com")
+	assert.Equal(t, service.Addr, "10.0.0.1")
+	_, _, ok = s.lookupService("example.org")
+	assert.Equal(t, ok, false)
+}
+
+// changingResolver is a custom resolver whose services change at runtime
+type changingResolver struct {
+	StaticResolver
+	changed func()
+}
+
+func (r *changingResolver) OnChange(fn func()) { r.changed = fn }
+
+func TestServerWithChangingResolver(t *testing.T) {
+	service := Service{Addr: "127.0.0.1", HTTPPort: 80, HealthCheck: HealthCheckConfig{Type: HealthCheckTCP}}
+	resolver := &changingResolver{StaticResolver: StaticResolver{"a.com": service}}
+	s := NewServerWithResolver(ServerOptions{}, nil, resolver)
+	require.NotNil(t, resolver.changed)
+
+	_, err := s.balancer("a.com", service)
+	require.NoError(t, err)
+	assert.Equal(t, len(s.health.targets), 1)
+
+	// the balancer and health checks of a removed service are dropped once notified
+	resolver.StaticResolver = StaticResolver{}
+	resolver.changed()
+	assert.Equal(t, len(s.balancers), 0)
+	assert.Equal(t, len(s.health.targets), 0)
+}
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "services.toml")
+	write := func(content string, modTime time.Time) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	now := time.Now()
+	write(`
+[services."A.com"]
+addr = "127.0.0.1"
+tlsport = 443
+`, now)
+
+	r, err := NewFileResolver(path, time.Minute)
+	require.NoError(t, err)
+	service, ok := r.Resolve("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.TLSPort, 443)
+
+	// invalid content keeps the previous services
+	write(`[services."a.com"]
+certfile = "only.crt"
+`, now.Add(time.Second))
+	require.Error(t, r.reload())
+	_, ok = r.Resolve("a.com")
+	assert.Equal(t, ok, true)
+
+	write(`[services."b.com"]
+addr = "127.0.0.2"
+`, now.Add(2*time.Second))
+	require.NoError(t, r.reload())
+	_, ok = r.Resolve("a.com")
+	assert.Equal(t, ok, false)
+	_, ok = r.Resolve("b.com")
+	assert.Equal(t, ok, true)
+
+	jsonPath := filepath.Join(dir, "services.json")
+	require.NoError(t, ioutil.WriteFile(jsonPath, []byte(`{"services": {"c.com": {"addr": "127.0.0.3", "httpport": 8080}}}`), 0600))
+	r, err = NewFileResolver(jsonPath, time.Minute)
+	require.NoError(t, err)
+	service, ok = r.Resolve("c.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.HTTPPort, 8080)
+
+	_, err = NewFileResolver(filepath.Join(dir, "missing.toml"), time.Minute)
+	require.Error(t, err)
+}
+
+func TestServerPrunesRemovedServices(t *testing.T) {
+	kv := newMemStore()
+	service := Service{Addr: "127.0.0.1", HealthCheck: HealthCheckConfig{Type: HealthCheckTCP}}
+	putService(t, kv, "a.com", service)
+	s := NewServer(ServerOptions{}, kv, nil)
+	resolver := s.services.(ChainResolver)[1].(*KVResolver)
+	require.NoError(t, resolver.table.load())
+
+	_, err := s.balancer("a.com", service)
+	require.NoError(t, err)
+	assert.Equal(t, len(s.health.targets), 1)
+
+	require.NoError(t, kv.Delete(serviceKey("a.com")))
+	require.NoError(t, resolver.table.load())
+	_, ok := s.balancers["a.com"]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, len(s.health.targets), 0)
+}
+
+func TestFileResolverRemovedService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.toml")
+	write := func(content string, modTime time.Time) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	now := time.Now()
+	write(`
+[services."a.com"]
+addr = "127.0.0.1"
+tlsport = 443
+[services."a.com".healthcheck]
+type = "tcp"
+`, now)
+
+	r, err := NewFileResolver(path, time.Minute)
+	require.NoError(t, err)
+	s := NewServerWithResolver(ServerOptions{}, nil, r)
+	_, service, ok := s.lookupService("a.com")
+	require.True(t, ok)
+	_, err = s.balancer("a.com", service)
+	require.NoError(t, err)
+
+	// the health checks stop once the service is removed from the file
+	write(`[services."b.com"]
+addr = "127.0.0.2"
+`, now.Add(time.Second))
+	require.NoError(t, r.reload())
+	_, ok = s.balancers["a.com"]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, len(s.health.targets), 0)
+}
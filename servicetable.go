@@ -0,0 +1,207 @@
+package tcprouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// servicePrefix is the prefix of the keys of the services in the db backend
+	servicePrefix = "tcprouter/service/"
+	// defaultServiceRefresh is the interval at which the services are reloaded when refresh is not set
+	defaultServiceRefresh = 10 * time.Second
+)
+
+func serviceKey(host string) string {
+	return fmt.Sprintf("%s%s", servicePrefix, host)
+}
+
+// serviceTable keeps the services of the db backend in memory. It is bulk loaded from the
+// services prefix and kept up to date by polling the backend or by watching the prefix.
+// Once loaded, the table is authoritative and lookups never reach the backend
+type serviceTable struct {
+	kv store.Store
+
+	mu       sync.RWMutex
+	loaded   bool
+	services map[string]Service
+	// misses holds until when the names not found in the backend are not queried again,
+	// until the table is loaded
+	misses  map[string]time.Time
+	refresh time.Duration
+	// changed is called after the services are replaced
+	changed func()
+}
+
+func newServiceTable(kv store.Store, refresh time.Duration) *serviceTable {
+	if refresh <= 0 {
+		refresh = defaultServiceRefresh
+	}
+	return &serviceTable{
+		kv:       kv,
+		services: make(map[string]Service),
+		misses:   make(map[string]time.Time),
+		refresh:  refresh,
+	}
+}
+
+// get reads the service of host from the backend
+func (t *serviceTable) get(host string) (Service, error) {
+	service := Service{}
+
+	key := serviceKey(host)
+	servicePair, err := t.kv.Get(key, nil)
+	if err != nil {
+		return service, fmt.Errorf("host not found at key %s: %w", key, err)
+	}
+
+	err = json.Unmarshal(servicePair.Value, &service)
+	if err != nil {
+		return service, fmt.Errorf("invalid service content")
+	}
+	if err := service.validate(); err != nil {
+		return service, fmt.Errorf("invalid service at key %s: %w", key, err)
+	}
+
+	log.Debug().
+		Str("key", key).
+		Str("service", fmt.Sprintf("%v", service)).
+		Msg("service found")
+	return service, nil
+}
+
+// lookup returns the service registered under name. Until the table is loaded
+// the backend is queried directly, and the names it doesn't know are not queried
+// again for a refresh interval
+func (t *serviceTable) lookup(name string) (Service, bool) {
+	t.mu.RLock()
+	service, ok := t.services[name]
+	loaded := t.loaded
+	missed := time.Now().Before(t.misses[name])
+	t.mu.RUnlock()
+	if ok || loaded || missed {
+		return service, ok
+	}
+
+	log.Debug().Str("name", name).Msg("service table not loaded yet, try to load it from db backend")
+	service, err := t.get(name)
+	if err != nil {
+		t.mu.Lock()
+		if !t.loaded {
+			t.misses[name] = time.Now().Add(t.refresh)
+		}
+		t.mu.Unlock()
+		return Service{}, false
+	}
+	return service, true
+}
+
+// parseServices decodes the services of pairs, the invalid ones are logged and skipped
+func parseServices(pairs []*store.KVPair) map[string]Service {
+	services := make(map[string]Service, len(pairs))
+	for _, pair := range pairs {
+		// some backends return the keys without their leading slash, others with it
+		name := strings.TrimPrefix(strings.TrimPrefix(pair.Key, "/"), servicePrefix)
+		var service Service
+		if err := json.Unmarshal(pair.Value, &service); err != nil {
+			log.Error().Err(err).Str("key", pair.Key).Msg("invalid service content")
+			continue
+		}
+		if err := service.validate(); err != nil {
+			log.Error().Err(err).Str("key", pair.Key).Msg("invalid service")
+			continue
+		}
+		services[normalizeHost(name)] = service
+	}
+	return services
+}
+
+// notify sets the function called after the services are replaced
+func (t *serviceTable) notify(fn func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.changed = fn
+}
+
+// replace swaps the content of the table with services
+func (t *serviceTable) replace(services map[string]Service) {
+	t.mu.Lock()
+	t.services = services
+	t.loaded = true
+	t.misses = nil
+	changed := t.changed
+	t.mu.Unlock()
+
+	if changed != nil {
+		changed()
+	}
+}
+
+// load reads all the services of the backend
+func (t *serviceTable) load() error {
+	pairs, err := t.kv.List(servicePrefix, nil)
+	if err == store.ErrKeyNotFound {
+		pairs, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	services := parseServices(pairs)
+	t.replace(services)
+	log.Debug().Int("services", len(services)).Msg("service table loaded")
+	return nil
+}
+
+// run keeps the table up to date until ctx is done. The table is reloaded every refresh interval,
+// and the prefix of the services is watched as well if the backend supports it so changes are
+// applied right away. Polling goes on while watching since a watch can stop firing without error,
+// e.g. when the redis keyspace notifications can't be enabled
+func (t *serviceTable) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.watch(ctx)
+	}()
+
+	ticker := time.NewTicker(t.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.load(); err != nil {
+				// the last loaded services are kept
+				log.Error().Err(err).Msg("failed to refresh services from db backend")
+			}
+		}
+	}
+}
+
+// watch applies the changes of the services notified by the backend until ctx is done
+func (t *serviceTable) watch(ctx context.Context) {
+	events, err := t.kv.WatchTree(servicePrefix, ctx.Done(), nil)
+	if err == store.ErrCallNotSupported {
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Msg("failed to watch db backend, polling for service changes")
+		return
+	}
+
+	log.Info().Msg("watching db backend for service changes")
+	for pairs := range events {
+		t.replace(parseServices(pairs))
+	}
+	if ctx.Err() == nil {
+		log.Warn().Msg("watch of db backend stopped, polling for service changes")
+	}
+}
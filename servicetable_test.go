@@ -0,0 +1,160 @@
+package tcprouter
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abronan/valkeyrie/store"
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the Get calls made on a memStore
+type countingStore struct {
+	*memStore
+	gets int32
+}
+
+func (c *countingStore) Get(key string, options *store.ReadOptions) (*store.KVPair, error) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.memStore.Get(key, options)
+}
+
+func putService(t *testing.T, kv store.Store, host string, service Service) {
+	data, err := json.Marshal(service)
+	require.NoError(t, err)
+	require.NoError(t, kv.Put(serviceKey(host), data, nil))
+}
+
+func TestServiceTable(t *testing.T) {
+	kv := &countingStore{memStore: newMemStore()}
+	putService(t, kv, "a.com", Service{Addr: "127.0.0.1", TLSPort: 443})
+	putService(t, kv, "Wild.COM", Service{Addr: "127.0.0.2"})
+	require.NoError(t, kv.Put(serviceKey("broken.com"), []byte("{"), nil))
+	putService(t, kv, "invalid.com", Service{CertFile: "only.crt"})
+
+	table := newServiceTable(kv, time.Minute)
+
+	// until the table is loaded the backend is queried, invalid services are refused
+	service, ok := table.lookup("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.TLSPort, 443)
+	_, ok = table.lookup("invalid.com")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, atomic.LoadInt32(&kv.gets), int32(2))
+
+	require.NoError(t, table.load())
+	service, ok = table.lookup("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.TLSPort, 443)
+	_, ok = table.lookup("wild.com")
+	assert.Equal(t, ok, true)
+
+	// once loaded, unknown names never reach the backend
+	_, ok = table.lookup("b.com")
+	assert.Equal(t, ok, false)
+	putService(t, kv, "b.com", Service{Addr: "127.0.0.3"})
+	_, ok = table.lookup("b.com")
+	assert.Equal(t, ok, false)
+	assert.Equal(t, atomic.LoadInt32(&kv.gets), int32(2))
+
+	require.NoError(t, table.load())
+	service, ok = table.lookup("b.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, service.Addr, "127.0.0.3")
+
+	// invalid entries are skipped
+	_, ok = table.lookup("broken.com")
+	assert.Equal(t, ok, false)
+	_, ok = table.lookup("invalid.com")
+	assert.Equal(t, ok, false)
+}
+
+// silentWatchStore accepts watches that never fire, like a redis refusing to enable keyspace notifications
+type silentWatchStore struct {
+	*memStore
+}
+
+func (s silentWatchStore) WatchTree(directory string, stopCh <-chan struct{}, options *store.ReadOptions) (<-chan []*store.KVPair, error) {
+	events := make(chan []*store.KVPair)
+	go func() {
+		<-stopCh
+		close(events)
+	}()
+	return events, nil
+}
+
+func TestServiceTableRefresh(t *testing.T) {
+	for name, kv := range map[string]store.Store{
+		"polling":      newMemStore(),
+		"silent watch": silentWatchStore{newMemStore()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			table := newServiceTable(kv, 50*time.Millisecond)
+			require.NoError(t, table.load())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go table.run(ctx)
+
+			known := func(name string) bool {
+				table.mu.RLock()
+				defer table.mu.RUnlock()
+				_, ok := table.services[name]
+				return ok
+			}
+			wait := func(name string, want bool) {
+				for i := 0; i < 50; i++ {
+					if known(name) == want {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+				t.Fatalf("service %s known: %v, want %v", name, !want, want)
+			}
+
+			putService(t, kv, "a.com", Service{Addr: "127.0.0.1"})
+			wait("a.com", true)
+			require.NoError(t, kv.Delete(serviceKey("a.com")))
+			wait("a.com", false)
+		})
+	}
+}
+
+func TestLookupServiceFromStore(t *testing.T) {
+	kv := newMemStore()
+	putService(t, kv, "a.com", Service{Addr: "127.0.0.1"})
+	s := NewServer(ServerOptions{}, kv, map[string]Service{
+		"static.com": {Addr: "127.0.0.2"},
+	})
+
+	name, service, ok := s.lookupService("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, name, "a.com")
+	assert.Equal(t, service.Addr, "127.0.0.1")
+	_, _, ok = s.lookupService("static.com")
+	assert.Equal(t, ok, true)
+	_, _, ok = s.lookupService("unknown.com")
+	assert.Equal(t, ok, false)
+}
+
+func TestServiceTableMisses(t *testing.T) {
+	kv := &countingStore{memStore: newMemStore()}
+	table := newServiceTable(kv, 100*time.Millisecond)
+
+	// until the table is loaded, unknown names are queried once per refresh interval
+	for i := 0; i < 3; i++ {
+		_, ok := table.lookup("a.com")
+		assert.Equal(t, ok, false)
+	}
+	assert.Equal(t, atomic.LoadInt32(&kv.gets), int32(1))
+
+	putService(t, kv, "a.com", Service{Addr: "127.0.0.1"})
+	time.Sleep(150 * time.Millisecond)
+	_, ok := table.lookup("a.com")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, atomic.LoadInt32(&kv.gets), int32(2))
+}
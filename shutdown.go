@@ -0,0 +1,172 @@
+package tcprouter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultShutdownTimeout is the time given to active connections to finish on shutdown
+	defaultShutdownTimeout = 30 * time.Second
+	// interval at which Shutdown checks if all the connections are done
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
+func (c TimeoutsConfig) shutdown() time.Duration {
+	if c.Shutdown == 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(c.Shutdown) * time.Second
+}
+
+// ShutdownTimeout returns the time given to active connections to finish when the server stops
+func (o ServerOptions) ShutdownTimeout() time.Duration {
+	return o.Timeouts.shutdown()
+}
+
+// trackConnection registers conn as active until the returned function is called
+func (s *Server) trackConnection(conn WriteCloser) func() {
+	s.connsMU.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsMU.Unlock()
+
+	return func() {
+		s.connsMU.Lock()
+		delete(s.conns, conn)
+		s.connsMU.Unlock()
+	}
+}
+
+func (s *Server) activeCount() int {
+	s.connsMU.Lock()
+	defer s.connsMU.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) isShuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// onShutdown calls f if the server starts shutting down before the returned function is called.
+// f is never called once the returned function returned
+func (s *Server) onShutdown(f func()) func() {
+	var (
+		mu      sync.Mutex
+		stopped bool
+		done    = make(chan struct{})
+	)
+	go func() {
+		select {
+		case <-s.shutdown:
+			mu.Lock()
+			if !stopped {
+				f()
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		close(done)
+	}
+}
+
+// notifyGoAway tells the client of session the server is shutting down so it reconnects
+// without waiting for the session to be closed
+func notifyGoAway(session *tunnelSession) {
+	stream, err := session.OpenStream()
+	if err == nil {
+		err = streamHeader{kind: streamGoAway}.Write(stream)
+		stream.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to notify tunnel client")
+	}
+}
+
+func (s *Server) closeListeners() {
+	s.listenersMU.Lock()
+	defer s.listenersMU.Unlock()
+	for id, l := range s.listeners {
+		l.close()
+		delete(s.listeners, id)
+	}
+	for name, l := range s.udpListeners {
+		l.close()
+		delete(s.udpListeners, name)
+	}
+}
+
+// Shutdown stops the server gracefully: the listeners are closed, the tunnel clients supporting
+// stream headers are told to reconnect and the active connections are given until ctx is done to finish.
+// The connections still open then are closed, their number is returned with the error of ctx.
+// Start returns once Shutdown is done
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	started := false
+	s.shutdownOnce.Do(func() {
+		started = true
+		close(s.shutdown)
+	})
+	if !started {
+		<-s.drained
+		return 0, nil
+	}
+	defer close(s.drained)
+
+	log.Info().Int("active connections", s.activeCount()).Msg("shutting down, draining connections")
+	s.closeListeners()
+
+	s.activeConnectionsMU.Lock()
+	for _, sessions := range s.activeConnections {
+		for _, session := range sessions {
+			if session.streamHeaders {
+				go notifyGoAway(session)
+			}
+		}
+	}
+	s.activeConnectionsMU.Unlock()
+
+	var err error
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.activeCount() != 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	s.connsMU.Lock()
+	cut := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMU.Unlock()
+
+	s.activeConnectionsMU.Lock()
+	for _, sessions := range s.activeConnections {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}
+	s.activeConnectionsMU.Unlock()
+
+	if cut != 0 {
+		log.Warn().Int("connections cut", cut).Msg("shutdown deadline reached, connections closed")
+	}
+	log.Info().Msg("shutdown complete")
+	return cut, err
+}
@@ -0,0 +1,175 @@
+package tcprouter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	var (
+		httpsPort  uint = 8010
+		httpPort   uint = 8011
+		clientPort uint = 8012
+	)
+	s := NewServer(ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        httpsPort,
+		ListeningHTTPPort:       httpPort,
+		ListeningForClientsPort: clientPort,
+	}, nil, map[string]Service{
+		"a.com": {Addr: "127.0.0.1", HTTPPort: backend.Addr().(*net.TCPAddr).Port},
+	})
+	started := make(chan error)
+	go func() {
+		started <- s.Start(context.Background())
+	}()
+	addr := fmt.Sprintf("127.0.0.1:%d", httpPort)
+	waitListening(t, addr)
+
+	open := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, line, "GET / HTTP/1.1\r\n")
+		return conn
+	}
+	done, cut := open(), open()
+	defer cut.Close()
+	// give the server time to register the connections
+	time.Sleep(100 * time.Millisecond)
+
+	type result struct {
+		cut int
+		err error
+	}
+	shutdown := make(chan result)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		n, err := s.Shutdown(ctx)
+		shutdown <- result{n, err}
+	}()
+
+	// new connections are refused while the active ones keep working
+	time.Sleep(100 * time.Millisecond)
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+	_, err = done.Write([]byte("still there\n"))
+	require.NoError(t, err)
+	done.Close()
+
+	select {
+	case <-started:
+		t.Fatal("Start returned before the connections were drained")
+	default:
+	}
+
+	res := <-shutdown
+	assert.Equal(t, res.cut, 1)
+	assert.Equal(t, res.err, context.DeadlineExceeded)
+	require.NoError(t, <-started)
+
+	cut.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = cut.Read(make([]byte, 64))
+	require.Error(t, err)
+}
+
+func TestShutdownNotifiesClients(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	const secret = "secret"
+	httpPort, clientsPort := closedPort(t), closedPort(t)
+	s := NewServer(ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningTLSPort:        uint(closedPort(t)),
+		ListeningHTTPPort:       uint(httpPort),
+		ListeningForClientsPort: uint(clientsPort),
+	}, nil, map[string]Service{"a.com": {ClientSecret: secret}})
+	go s.Start(context.Background())
+	clientsAddr := fmt.Sprintf("127.0.0.1:%d", clientsPort)
+	waitListening(t, clientsAddr)
+
+	client := NewClient(secret, local.Addr().String(), local.Addr().String(), clientsAddr)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- client.Start(context.Background())
+	}()
+	for i := 0; i < 50 && len(s.sessions(secret)) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// a connection forwarded by the client keeps the server draining
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\n\r\n"))
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "GET / HTTP/1.1\r\n")
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+
+	// the client is told to reconnect before its session is closed
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-shutdown:
+		t.Fatal("client not notified before the end of the shutdown")
+	}
+	_, err = conn.Write([]byte("still there\n"))
+	require.NoError(t, err)
+	for line != "still there\n" {
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+	}
+	<-shutdown
+}
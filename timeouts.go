@@ -0,0 +1,169 @@
+package tcprouter
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultSniffTimeout bounds the time given to clients to send their TLS ClientHello or HTTP headers
+const defaultSniffTimeout = 10 * time.Second
+
+// TimeoutsConfig bounds how long the router keeps connections open
+type TimeoutsConfig struct {
+	// Sniff is the time in seconds given to clients to send the TLS ClientHello or
+	// the HTTP headers used to route their connection, default to 10
+	Sniff uint `toml:"sniff"`
+	// Idle is the default time in seconds after which connections without traffic in
+	// either direction are closed, 0 disables it
+	Idle uint `toml:"idle"`
+	// MaxLifetime is the default time in seconds after which connections are closed
+	// whatever their activity, 0 disables it
+	MaxLifetime uint `toml:"maxlifetime"`
+	// Shutdown is the time in seconds given to active connections to finish
+	// when the server stops, default to 30
+	Shutdown uint `toml:"shutdown"`
+}
+
+func (c TimeoutsConfig) sniff() time.Duration {
+	if c.Sniff == 0 {
+		return defaultSniffTimeout
+	}
+	return time.Duration(c.Sniff) * time.Second
+}
+
+// connTimeouts bounds the life of a forwarded connection
+type connTimeouts struct {
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+// timeouts returns the timeouts of the connections forwarded to service,
+// the defaults of the server are used for the ones it doesn't set
+func (s *Server) timeouts(service Service) connTimeouts {
+	idle, lifetime := service.IdleTimeout, service.MaxLifetime
+	if idle == 0 {
+		idle = s.ServerOptions.Timeouts.Idle
+	}
+	if lifetime == 0 {
+		lifetime = s.ServerOptions.Timeouts.MaxLifetime
+	}
+	return connTimeouts{
+		idle:     time.Duration(idle) * time.Second,
+		lifetime: time.Duration(lifetime) * time.Second,
+	}
+}
+
+// watchdog closes a pair of forwarded connections once they have been idle
+// or open for too long
+type watchdog struct {
+	// last is the time in unix nanoseconds at which bytes were last read from either connection
+	last    int64
+	expired int32
+
+	timeouts connTimeouts
+	start    time.Time
+	conns    []WriteCloser
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// activityConn records the time data is read from a connection on its watchdog
+type activityConn struct {
+	WriteCloser
+	w *watchdog
+}
+
+// Read reads from the underlying connection and records the activity
+func (c activityConn) Read(p []byte) (int, error) {
+	n, err := c.WriteCloser.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.w.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watch starts a watchdog enforcing the timeouts on local and remote and returns
+// the connections to forward from. The watchdog must be stopped once forwarding is done
+func (t connTimeouts) watch(local, remote WriteCloser) (WriteCloser, WriteCloser, *watchdog) {
+	if t.idle <= 0 && t.lifetime <= 0 {
+		return local, remote, nil
+	}
+
+	now := time.Now()
+	w := &watchdog{
+		last:     now.UnixNano(),
+		timeouts: t,
+		start:    now,
+		conns:    []WriteCloser{local, remote},
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+
+	if t.idle <= 0 {
+		return local, remote, w
+	}
+	return activityConn{local, w}, activityConn{remote, w}, w
+}
+
+func (w *watchdog) run() {
+	var lifetime, idle <-chan time.Time
+	if w.timeouts.lifetime > 0 {
+		timer := time.NewTimer(w.timeouts.lifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	var idleTimer *time.Timer
+	if w.timeouts.idle > 0 {
+		idleTimer = time.NewTimer(w.timeouts.idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-lifetime:
+			w.expire(fmt.Errorf("maximum lifetime of %s reached", w.timeouts.lifetime))
+			return
+		case now := <-idle:
+			last := time.Unix(0, atomic.LoadInt64(&w.last))
+			if remaining := w.timeouts.idle - now.Sub(last); remaining > 0 {
+				// there was traffic since the timer was started
+				idleTimer.Reset(remaining)
+				continue
+			}
+			w.expire(fmt.Errorf("idle for %s", w.timeouts.idle))
+			return
+		}
+	}
+}
+
+func (w *watchdog) expire(reason error) {
+	atomic.StoreInt32(&w.expired, 1)
+	log.Info().
+		Err(reason).
+		Str("remote addr", w.conns[0].RemoteAddr().String()).
+		Dur("age", time.Since(w.start)).
+		Msg("closing connection")
+	for _, conn := range w.conns {
+		conn.Close()
+	}
+}
+
+// stop stops the watchdog
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() { close(w.stopped) })
+}
+
+// hasExpired returns true if the watchdog closed the connections
+func (w *watchdog) hasExpired() bool {
+	return w != nil && atomic.LoadInt32(&w.expired) == 1
+}
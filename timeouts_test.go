@@ -0,0 +1,203 @@
+package tcprouter
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forwardPipes forwards between two pipes with timeouts and returns the client and
+// backend ends, and a channel closed once forwarding stopped
+func forwardPipes(timeouts connTimeouts) (net.Conn, net.Conn, <-chan struct{}) {
+	client, local := net.Pipe()
+	remote, backend := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		forwardConnection(pipeConn{local}, pipeConn{remote}, timeouts)
+		close(done)
+	}()
+	return client, backend, done
+}
+
+func TestIdleTimeout(t *testing.T) {
+	client, backend, done := forwardPipes(connTimeouts{idle: 200 * time.Millisecond})
+	defer client.Close()
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := backend.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	// traffic keeps the connection open past the idle timeout
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := client.Write([]byte("x"))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("connection closed while active")
+	default:
+	}
+
+	select {
+	case <-done:
+		assert.Equal(t, time.Since(start) > 400*time.Millisecond, true)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	client, backend, done := forwardPipes(connTimeouts{idle: time.Minute, lifetime: 200 * time.Millisecond})
+	defer client.Close()
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := backend.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for {
+		if _, err := client.Write([]byte("x")); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("connection not closed after its lifetime")
+		}
+	}
+	<-done
+	assert.Equal(t, time.Since(start) >= 200*time.Millisecond, true)
+}
+
+func TestServiceTimeouts(t *testing.T) {
+	s := NewServer(ServerOptions{Timeouts: TimeoutsConfig{Idle: 60, MaxLifetime: 3600}}, nil, nil)
+	assert.Equal(t, s.timeouts(Service{}), connTimeouts{idle: time.Minute, lifetime: time.Hour})
+	assert.Equal(t, s.timeouts(Service{IdleTimeout: 5}), connTimeouts{idle: 5 * time.Second, lifetime: time.Hour})
+	assert.Equal(t, NewServer(ServerOptions{}, nil, nil).timeouts(Service{}), connTimeouts{})
+}
+
+func TestSniffTimeout(t *testing.T) {
+	backend := lineEcho(t)
+	defer backend.Close()
+	s := NewServer(ServerOptions{Timeouts: TimeoutsConfig{Sniff: 1}}, nil, map[string]Service{
+		catchAllService: {Addr: "127.0.0.1", HTTPPort: backend.Addr().(*net.TCPAddr).Port},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn.(*net.TCPConn))
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// a client sending nothing is disconnected once the sniff timeout is over
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.Equal(t, time.Since(start) < 2*time.Second, true)
+
+	// the deadline is cleared for the connections that were routed
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Write([]byte("hel"))
+	require.NoError(t, err)
+	time.Sleep(1500 * time.Millisecond)
+	_, err = conn.Write([]byte("lo\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+}
+
+func TestHTTPSniffTimeout(t *testing.T) {
+	s := NewServer(ServerOptions{Timeouts: TimeoutsConfig{Sniff: 1}}, nil, nil)
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// headers never completed
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.com\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusRequestTimeout)
+}
+
+func TestHTTPRequestModeTimeouts(t *testing.T) {
+	// backend reading the requests without ever answering
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+			}()
+		}
+	}()
+
+	s := NewServer(ServerOptions{HTTP: HTTPConfig{Mode: HTTPModeRequest}}, nil, map[string]Service{
+		"a.com": {Addr: "127.0.0.1", HTTPPort: backend.Addr().(*net.TCPAddr).Port, IdleTimeout: 1},
+	})
+	l := serveHTTP(t, s)
+	defer l.Close()
+
+	for _, req := range []string{
+		// the backend never answers
+		"GET / HTTP/1.1\r\nHost: a.com\r\n\r\n",
+		// the body is never completed
+		"POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 10\r\n\r\nab",
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn.Write([]byte(req))
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, err, io.EOF)
+		conn.Close()
+	}
+}
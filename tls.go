@@ -52,39 +52,55 @@ func (c *Conn) Read(p []byte) (n int, err error) {
 // without consuming any bytes from br.
 // On any error, the empty string is returned.
 func clientHelloServerName(br *bufio.Reader) (string, bool, string) {
+	hello, isTLS, peeked := peekClientHello(br)
+	return hello.serverName, isTLS, peeked
+}
+
+// clientHello holds the routing hints sent by a client in its TLS ClientHello
+type clientHello struct {
+	serverName string
+	// protocols are the ALPN protocols offered by the client, in its order of preference
+	protocols []string
+}
+
+// peekClientHello returns the routing hints inside the TLS ClientHello,
+// without consuming any bytes from br.
+// On any error, empty hints are returned.
+func peekClientHello(br *bufio.Reader) (clientHello, bool, string) {
 	hdr, err := br.Peek(1)
 	if err != nil {
 		if err != io.EOF {
 			log.Error().Err(err).Msg("Error while Peeking first byte")
 		}
-		return "", false, ""
+		return clientHello{}, false, ""
 	}
 	const recordTypeHandshake = 0x16
 	if hdr[0] != recordTypeHandshake {
-		return "", false, getPeeked(br) // Not TLS.
+		return clientHello{}, false, getPeeked(br) // Not TLS.
 	}
 
 	const recordHeaderLen = 5
 	hdr, err = br.Peek(recordHeaderLen)
 	if err != nil {
 		log.Error().Err(err).Msg("Error while Peeking hello")
-		return "", false, getPeeked(br)
+		return clientHello{}, false, getPeeked(br)
 	}
 	recLen := int(hdr[3])<<8 | int(hdr[4]) // ignoring version in hdr[1:3]
 	helloBytes, err := br.Peek(recordHeaderLen + recLen)
 	if err != nil {
 		log.Error().Err(err).Msg("Error while Hello")
-		return "", true, getPeeked(br)
+		return clientHello{}, true, getPeeked(br)
 	}
-	sni := ""
+	var info clientHello
 	server := tls.Server(sniSniffConn{r: bytes.NewReader(helloBytes)}, &tls.Config{
 		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
-			sni = hello.ServerName
+			info.serverName = hello.ServerName
+			info.protocols = hello.SupportedProtos
 			return nil, nil
 		},
 	})
 	_ = server.Handshake()
-	return sni, true, getPeeked(br)
+	return info, true, getPeeked(br)
 }
 
 func getPeeked(br *bufio.Reader) string {
@@ -0,0 +1,451 @@
+package tcprouter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultUDPIdleTimeout = 60
+	defaultUDPMaxFlows    = 1024
+	maxDatagramSize       = 65535
+	// datagrams received while the flow connects to its backend are queued up to this number
+	maxPendingDatagrams = 16
+)
+
+// errFlowClosed is returned when a datagram is sent on a closed flow
+var errFlowClosed = errors.New("flow closed")
+
+// UDPEntrypointConfig defines a listener that forwards UDP datagrams to a single service.
+// Datagrams are grouped in flows by source address, each flow has its own
+// connection to a backend or its own stream on the tunnel of the client
+type UDPEntrypointConfig struct {
+	// Addr is the listening address, default to the address of the server
+	Addr string `toml:"addr"`
+	Port uint   `toml:"port"`
+	// IdleTimeout is the number of seconds without datagram after which a flow is closed
+	IdleTimeout uint `toml:"idletimeout"`
+	// MaxFlows is the maximum number of concurrent flows, default to 1024
+	MaxFlows uint    `toml:"maxflows"`
+	Service  Service `toml:"service"`
+}
+
+func (e UDPEntrypointConfig) validate() error {
+	if e.Port == 0 {
+		return fmt.Errorf("no port configured")
+	}
+	if e.Service.ClientSecret == "" && e.Service.Addr == "" && len(e.Service.Backends) == 0 {
+		return fmt.Errorf("no backend or client secret configured")
+	}
+	return nil
+}
+
+// service returns the service of the entrypoint, its backends default to the port of the entrypoint
+func (e UDPEntrypointConfig) service() Service {
+	service := e.Service
+	if service.UDPPort == 0 {
+		service.UDPPort = int(e.Port)
+	}
+	return service
+}
+
+func (e UDPEntrypointConfig) idleTimeout() time.Duration {
+	if e.IdleTimeout == 0 {
+		return defaultUDPIdleTimeout * time.Second
+	}
+	return time.Duration(e.IdleTimeout) * time.Second
+}
+
+func (e UDPEntrypointConfig) maxFlows() int {
+	if e.MaxFlows == 0 {
+		return defaultUDPMaxFlows
+	}
+	return int(e.MaxFlows)
+}
+
+// UDPEntrypointAddr returns the listening address of an UDP entrypoint
+func (o ServerOptions) UDPEntrypointAddr(ep UDPEntrypointConfig) string {
+	addr := ep.Addr
+	if addr == "" {
+		addr = o.ListeningAddr
+	}
+	return fmt.Sprintf("%s:%d", addr, ep.Port)
+}
+
+// writeDatagram writes p on a stream prefixed by its size
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return fmt.Errorf("datagram too big")
+	}
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b[:2], uint16(len(p)))
+	copy(b[2:], p)
+	_, err := w.Write(b)
+	return err
+}
+
+// readDatagram reads a datagram written by writeDatagram into p
+func readDatagram(r io.Reader, p []byte) (int, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size))
+	if n > len(p) {
+		return 0, fmt.Errorf("datagram too big")
+	}
+	return io.ReadFull(r, p[:n])
+}
+
+// datagramStream carries datagrams over a stream, each Read and Write call handles a single datagram
+type datagramStream struct {
+	io.ReadWriteCloser
+	r io.Reader
+}
+
+func newDatagramStream(rwc io.ReadWriteCloser, r io.Reader) *datagramStream {
+	if r == nil {
+		r = rwc
+	}
+	return &datagramStream{ReadWriteCloser: rwc, r: r}
+}
+
+func (d *datagramStream) Read(p []byte) (int, error) {
+	return readDatagram(d.r, p)
+}
+
+func (d *datagramStream) Write(p []byte) (int, error) {
+	if err := writeDatagram(d.ReadWriteCloser, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// udpFlow is the set of datagrams received from a single source address
+type udpFlow struct {
+	src *net.UDPAddr
+
+	mu         sync.Mutex
+	lastActive time.Time
+	// conn is nil while the flow connects to its backend, the datagrams are queued meanwhile
+	conn    io.ReadWriteCloser
+	pending [][]byte
+	closed  bool
+}
+
+func newUDPFlow(src *net.UDPAddr) *udpFlow {
+	return &udpFlow{src: src, lastActive: time.Now()}
+}
+
+func (f *udpFlow) touch() {
+	f.mu.Lock()
+	f.lastActive = time.Now()
+	f.mu.Unlock()
+}
+
+func (f *udpFlow) idle(timeout time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Since(f.lastActive) > timeout
+}
+
+// send forwards p to the backend of the flow, or queues it while the flow connects.
+// Datagrams are dropped once the queue is full
+func (f *udpFlow) send(p []byte) error {
+	f.mu.Lock()
+	f.lastActive = time.Now()
+	if f.closed {
+		f.mu.Unlock()
+		return errFlowClosed
+	}
+	conn := f.conn
+	if conn == nil {
+		if len(f.pending) < maxPendingDatagrams {
+			f.pending = append(f.pending, append([]byte(nil), p...))
+		}
+		f.mu.Unlock()
+		return nil
+	}
+	f.mu.Unlock()
+
+	_, err := conn.Write(p)
+	return err
+}
+
+// connected sends the queued datagrams on conn, which is then used for the next ones
+func (f *udpFlow) connected(conn io.ReadWriteCloser) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errFlowClosed
+	}
+	for _, p := range f.pending {
+		if _, err := conn.Write(p); err != nil {
+			return err
+		}
+	}
+	f.conn, f.pending = conn, nil
+	return nil
+}
+
+func (f *udpFlow) close() {
+	f.mu.Lock()
+	f.closed = true
+	conn := f.conn
+	f.pending = nil
+	f.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// connectUDP opens the connection of a new flow, either a connected UDP socket
+// to one of the backends of service or a stream on the tunnel of its client
+func (s *Server) connectUDP(name string, service Service, src net.Addr) (io.ReadWriteCloser, func(), error) {
+	if service.ClientSecret != "" {
+		stream, release, err := s.openStream(name, service, streamHeader{kind: streamUDP}, make(map[*tunnelSession]bool))
+		if err != nil {
+			return nil, nil, err
+		}
+		return newDatagramStream(stream, nil), release, nil
+	}
+
+	lb, err := s.balancer(name, service)
+	if err != nil {
+		return nil, nil, err
+	}
+	i, ok := lb.pick(src, func(b Backend) bool {
+		return s.health.isUp(service, b)
+	})
+	if !ok {
+		return nil, nil, fmt.Errorf("service %s: %w", name, errNoBackend)
+	}
+
+	backend := lb.backends[i]
+	port := backend.UDPPort
+	if _, ok := unixSocketPath(backend.Addr); ok {
+		lb.release(i, false)
+		return nil, nil, fmt.Errorf("service %s: unix socket backends are not supported by udp entrypoints", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), service.dialTimeout())
+	defer cancel()
+	ips, err := s.resolver.resolve(ctx, backend.Addr)
+	if err != nil {
+		lb.release(i, true)
+		return nil, nil, err
+	}
+	// an unreachable address can't be detected with datagrams, only the
+	// addresses without route are skipped
+	var (
+		dialer net.Dialer
+		conn   net.Conn
+	)
+	for _, ip := range sortAddrs(ips) {
+		conn, err = dialer.DialContext(ctx, "udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		lb.release(i, true)
+		return nil, nil, err
+	}
+	// datagrams can't tell whether the backend is alive, a flow succeeds as soon as it is
+	// connected so it doesn't keep the backend ejected until its idle timeout
+	lb.report(i, false)
+	return conn, func() { lb.done(i) }, nil
+}
+
+// listenUDP binds the address of the udp entrypoint and forwards its datagrams in the background
+// until ctx is done, the server shuts down or the listener is closed
+func (s *Server) listenUDP(ctx context.Context, name string, ep UDPEntrypointConfig) error {
+	addr := s.options().UDPEntrypointAddr(ep)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve addr %s: %w", addr, err)
+	}
+	ln, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start listener on %s: %w", addr, err)
+	}
+
+	l := &udpListener{addr: addr, ln: ln, stop: make(chan struct{})}
+	l.setConfig(ep)
+	s.listenersMU.Lock()
+	s.udpListeners[name] = l
+	s.listenersMU.Unlock()
+
+	s.wg.Add(1)
+	go s.serveUDP(ctx, name, l)
+	return nil
+}
+
+func (s *Server) serveUDP(ctx context.Context, name string, l *udpListener) {
+	defer s.wg.Done()
+	defer l.close()
+
+	ln := l.ln
+	var (
+		serviceName = entrypointServiceName(name)
+		flows       = make(map[string]*udpFlow)
+		flowsMU     sync.Mutex
+		lastSweep   = time.Now()
+	)
+
+	closeFlow := func(f *udpFlow) {
+		flowsMU.Lock()
+		if flows[f.src.String()] == f {
+			delete(flows, f.src.String())
+		}
+		flowsMU.Unlock()
+		f.close()
+	}
+	defer func() {
+		flowsMU.Lock()
+		defer flowsMU.Unlock()
+		for _, f := range flows {
+			f.close()
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.shutdown:
+			return
+		case <-l.stop:
+			return
+		default:
+		}
+
+		// the configuration is replaced on reload, the flows keep the service they were created with
+		ep := l.config()
+		service := ep.service()
+		if time.Since(lastSweep) > time.Second {
+			lastSweep = time.Now()
+			timeout := ep.idleTimeout()
+			flowsMU.Lock()
+			var idle []*udpFlow
+			for _, f := range flows {
+				if f.idle(timeout) {
+					idle = append(idle, f)
+				}
+			}
+			flowsMU.Unlock()
+			for _, f := range idle {
+				log.Debug().Str("entrypoint", name).Str("remote addr", f.src.String()).Msg("closing idle flow")
+				closeFlow(f)
+			}
+		}
+
+		ln.SetReadDeadline(time.Now().Add(time.Second))
+		n, src, err := ln.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			log.Error().Err(err).Str("entrypoint", name).Msg("failed to read datagram")
+			continue
+		}
+
+		flowsMU.Lock()
+		flow, ok := flows[src.String()]
+		count := len(flows)
+		flowsMU.Unlock()
+		if !ok {
+			if err := s.checkAccess(service, src); err != nil {
+				log.Debug().Err(err).Str("entrypoint", name).Msg("datagram refused")
+				continue
+			}
+			if count >= ep.maxFlows() {
+				log.Debug().Str("entrypoint", name).Str("remote addr", src.String()).Msg("too many flows, datagram dropped")
+				continue
+			}
+			release, err := s.acquireFlow(serviceName, service, src)
+			if err != nil {
+				log.Debug().Err(err).Str("entrypoint", name).Str("remote addr", src.String()).Msg("datagram refused")
+				continue
+			}
+
+			flow = newUDPFlow(src)
+			flowsMU.Lock()
+			flows[src.String()] = flow
+			flowsMU.Unlock()
+
+			// connecting may take up to the dial timeout of the service, the
+			// datagrams of the other flows keep being forwarded meanwhile
+			go func(f *udpFlow) {
+				defer release()
+				defer closeFlow(f)
+
+				conn, done, err := s.connectUDP(serviceName, service, f.src)
+				if err != nil {
+					log.Error().Err(err).Str("entrypoint", name).Msg("error forwarding traffic")
+					return
+				}
+				defer done()
+				if err := f.connected(conn); err != nil {
+					conn.Close()
+					if err != errFlowClosed {
+						log.Error().Err(err).Str("entrypoint", name).Msg("failed to forward datagram")
+					}
+					return
+				}
+				log.Info().
+					Str("entrypoint", name).
+					Str("remote addr", f.src.String()).
+					Msg("new flow")
+
+				reply := make([]byte, maxDatagramSize)
+				for {
+					n, err := conn.Read(reply)
+					if err != nil {
+						return
+					}
+					f.touch()
+					if _, err := ln.WriteToUDP(reply[:n], f.src); err != nil {
+						log.Error().Err(err).Str("entrypoint", name).Msg("failed to send datagram")
+						return
+					}
+				}
+			}(flow)
+		}
+
+		if err := flow.send(buf[:n]); err != nil {
+			if err != errFlowClosed {
+				log.Error().Err(err).Str("entrypoint", name).Msg("failed to forward datagram")
+			}
+			closeFlow(flow)
+		}
+	}
+}
+
+// acquireFlow applies the limits of the router and of service to a new flow from src.
+// The returned function must be called once the flow is closed
+func (s *Server) acquireFlow(name string, service Service, src net.Addr) (func(), error) {
+	release, err := s.limiter.acquireConnection(s.ServerOptions.Limits, src)
+	if err != nil {
+		return nil, err
+	}
+	limited, err := s.limiter.acquireService(name, service.Limits)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return func() {
+		limited()
+		release()
+	}, nil
+}
@@ -0,0 +1,233 @@
+package tcprouter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	b := bytes.Buffer{}
+	stream := newDatagramStream(nopCloser{&b}, nil)
+
+	for _, msg := range []string{"hello", "", "world"} {
+		_, err := stream.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for _, msg := range []string{"hello", "", "world"} {
+		n, err := stream.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, string(buf[:n]), msg)
+	}
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// udpEcho starts an UDP server sending back every datagram it receives
+func udpEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], src)
+		}
+	}()
+	return conn
+}
+
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func testUDPEntrypoint(t *testing.T, service Service, local string) {
+	port := freeUDPPort(t)
+	clientsPort := closedPort(t)
+	s := NewServer(ServerOptions{
+		ListeningAddr:           "127.0.0.1",
+		ListeningForClientsPort: uint(clientsPort),
+		UDPEntrypoints: map[string]UDPEntrypointConfig{
+			"echo": {Port: uint(port), Service: service},
+		},
+	}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		require.NoError(t, s.Start(ctx))
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	clientsAddr := fmt.Sprintf("127.0.0.1:%d", clientsPort)
+	waitListening(t, clientsAddr)
+	if service.ClientSecret != "" {
+		client := NewClient(service.ClientSecret, "", "", clientsAddr)
+		client.SetLocalUDPAddr(local)
+		go client.Start(ctx)
+		for i := 0; i < 50 && len(s.sessions(service.ClientSecret)) == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 64)
+	for _, msg := range []string{"hello", "world"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, string(buf[:n]), msg)
+	}
+}
+
+func TestUDPEntrypoint(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	t.Run("direct", func(t *testing.T) {
+		testUDPEntrypoint(t, Service{
+			Addr:    "127.0.0.1",
+			UDPPort: echo.LocalAddr().(*net.UDPAddr).Port,
+		}, "")
+	})
+	t.Run("tunnel", func(t *testing.T) {
+		testUDPEntrypoint(t, Service{ClientSecret: "secret"}, echo.LocalAddr().String())
+	})
+}
+
+// udpEntrypointServer creates a server with a single udp entrypoint and returns the address of the entrypoint
+func udpEntrypointServer(t *testing.T, opts ServerOptions, ep UDPEntrypointConfig) (*Server, string) {
+	port := freeUDPPort(t)
+	ep.Port = uint(port)
+	opts.ListeningAddr = "127.0.0.1"
+	opts.ListeningForClientsPort = uint(closedPort(t))
+	opts.UDPEntrypoints = map[string]UDPEntrypointConfig{"echo": ep}
+	return NewServer(opts, nil, nil), fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+// startServer starts s and waits for its listeners to be ready
+func startServer(t *testing.T, ctx context.Context, s *Server) {
+	go s.Start(ctx)
+	waitListening(t, s.ServerOptions.ClientsAddr())
+}
+
+// echoes sends msg on conn and returns true if it is echoed back
+func echoes(t *testing.T, conn net.Conn, msg string, timeout time.Duration) bool {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	return err == nil && string(buf[:n]) == msg
+}
+
+func TestUDPSlowFlow(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the flows are balanced between both backends, the first one is connected to the slow one
+	s, addr := udpEntrypointServer(t, ServerOptions{}, UDPEntrypointConfig{
+		Service: Service{
+			UDPPort:  echo.LocalAddr().(*net.UDPAddr).Port,
+			Backends: []Backend{{Addr: "slow.example.com"}, {Addr: "fast.example.com"}},
+		},
+	})
+	// the resolution of the slow backend hangs until unblocked
+	unblock := make(chan struct{})
+	var calls int32
+	s.resolver.lookup = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		if host == "slow.example.com" {
+			atomic.AddInt32(&calls, 1)
+			<-unblock
+		}
+		return []net.IP{net.ParseIP("127.0.0.1")}, time.Nanosecond, nil
+	}
+	startServer(t, ctx, s)
+
+	slow, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer slow.Close()
+	_, err = slow.Write([]byte("queued"))
+	require.NoError(t, err)
+	for i := 0; i < 50 && atomic.LoadInt32(&calls) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the other flows are served while the first one connects
+	fast, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer fast.Close()
+	assert.Equal(t, echoes(t, fast, "hello", 2*time.Second), true)
+
+	// the datagrams received while connecting are forwarded once connected
+	close(unblock)
+	slow.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, err := slow.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, string(buf[:n]), "queued")
+}
+
+func TestUDPFlowLimits(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	service := Service{Addr: "127.0.0.1", UDPPort: echo.LocalAddr().(*net.UDPAddr).Port}
+
+	for name, cfg := range map[string]struct {
+		opts ServerOptions
+		ep   UDPEntrypointConfig
+	}{
+		"maxflows": {ep: UDPEntrypointConfig{MaxFlows: 1, Service: service}},
+		"router":   {opts: ServerOptions{Limits: LimitsConfig{MaxConnectionsPerIP: 1}}, ep: UDPEntrypointConfig{Service: service}},
+		"service":  {ep: UDPEntrypointConfig{Service: Service{Addr: service.Addr, UDPPort: service.UDPPort, Limits: ServiceLimits{MaxConnections: 1}}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s, addr := udpEntrypointServer(t, cfg.opts, cfg.ep)
+			startServer(t, ctx, s)
+
+			first, err := net.Dial("udp", addr)
+			require.NoError(t, err)
+			defer first.Close()
+			assert.Equal(t, echoes(t, first, "hello", 2*time.Second), true)
+
+			second, err := net.Dial("udp", addr)
+			require.NoError(t, err)
+			defer second.Close()
+			assert.Equal(t, echoes(t, second, "hello", 300*time.Millisecond), false)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package tcprouter
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// unixScheme prefixes the addresses of backends listening on a unix socket, e.g. unix:///run/app.sock
+const unixScheme = "unix://"
+
+// unixSocketPath returns the path of the socket if addr is a unix socket address
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// dialUnix connects to the unix socket at path. The returned *net.UnixConn
+// supports half-close through CloseWrite
+func dialUnix(ctx context.Context, path string) (*net.UnixConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UnixConn), nil
+}
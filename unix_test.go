@@ -0,0 +1,84 @@
+package tcprouter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unixEcho starts a server on a unix socket answering everything it reads once
+// the client closed its side of the connection
+func unixEcho(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "echo.sock")
+
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("echo "), data...))
+			}()
+		}
+	}()
+	return path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnixBackend(t *testing.T) {
+	path, stop := unixEcho(t)
+	defer stop()
+
+	service := Service{
+		Addr:        unixScheme + path,
+		HealthCheck: HealthCheckConfig{Type: HealthCheckTCP},
+	}
+	s := NewServer(ServerOptions{}, nil, map[string]Service{"example.com": service})
+
+	conn, release, err := s.connectService("example.com", service, streamHeader{kind: streamTunnel}, nil, backendPort(false))
+	require.NoError(t, err)
+	defer release()
+	defer conn.Close()
+
+	// the backend only answers once it got the end of the request
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), "echo hello")
+
+	target := &healthTarget{cfg: service.HealthCheck.withDefaults(), addr: service.HealthCheck.addr(service.Targets()[0])}
+	require.NoError(t, target.probe())
+}
+
+func TestClientUnixLocal(t *testing.T) {
+	path, stop := unixEcho(t)
+	defer stop()
+
+	c := NewClient("secret", unixScheme+path, "", "")
+	conn, err := c.connectLocal(c.localAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, string(data), "echo hello")
+}
@@ -0,0 +1,109 @@
+package tcprouter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// UpstreamTLSConfig configures the TLS connection to the backends of a service
+// that terminates TLS, the decrypted traffic is then encrypted again
+type UpstreamTLSConfig struct {
+	// Enabled makes the router connect to the TLS port of the backends with TLS
+	Enabled bool `toml:"enabled"`
+	// ServerName is the SNI sent to the backends and the name their certificate
+	// is verified against, default to the server name requested by the client
+	ServerName string `toml:"servername"`
+	// CAFile is a PEM file with the certificates trusted to verify the backends.
+	// System roots are used if not set
+	CAFile string `toml:"cafile"`
+	// CertFile and KeyFile are the client certificate presented to the backends
+	CertFile string `toml:"certfile"`
+	KeyFile  string `toml:"keyfile"`
+	// InsecureSkipVerify disables the verification of the certificate of the backends
+	InsecureSkipVerify bool `toml:"insecureskipverify"`
+}
+
+func (c UpstreamTLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("upstream certfile and keyfile must be set together")
+	}
+	return nil
+}
+
+type cachedPool struct {
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// caPool returns the certificates stored in file, they are reloaded when the file changes
+func (c *certificateStore) caPool(file string) (*x509.CertPool, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.pools[file]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.pool, nil
+	}
+
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+
+	c.mu.Lock()
+	c.pools[file] = cachedPool{pool: pool, modTime: info.ModTime()}
+	c.mu.Unlock()
+	return pool, nil
+}
+
+// upstreamTLS completes a TLS handshake with the backend reached through outgoing
+// and returns the encrypted connection
+func (s *Server) upstreamTLS(outgoing WriteCloser, serverName string, service Service) (WriteCloser, error) {
+	upstream := service.UpstreamTLS
+	cfg := &tls.Config{
+		ServerName:         upstream.ServerName,
+		InsecureSkipVerify: upstream.InsecureSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	if upstream.CAFile != "" {
+		pool, err := s.certificates.caPool(upstream.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream cafile: %w", err)
+		}
+		cfg.RootCAs = pool
+	}
+	if upstream.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.certificates.fromFiles(upstream.CertFile, upstream.KeyFile)
+		}
+	}
+
+	conn := tls.Client(outgoing, cfg)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("upstream tls handshake failed: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Debug().
+		Str("server name", serverName).
+		Str("upstream server name", cfg.ServerName).
+		Msg("upstream tls established")
+	return conn, nil
+}
@@ -0,0 +1,186 @@
+package tcprouter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+
+	publicCert, publicKey := selfSignedCert(t, "public.example.com")
+	backendCert, backendKey := selfSignedCert(t, "internal.local")
+	clientCert, clientKey := selfSignedCert(t, "router")
+
+	// the backend only accepts the client certificate of the router
+	backendPair, err := tls.X509KeyPair(backendCert, backendKey)
+	require.NoError(t, err)
+	clients := x509.NewCertPool()
+	clients.AppendCertsFromPEM(clientCert)
+	sni := make(chan string, 1)
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{backendPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(line))
+	}()
+
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"public.example.com": {
+			Addr:         "127.0.0.1",
+			TLSPort:      backend.Addr().(*net.TCPAddr).Port,
+			TerminateTLS: true,
+			CertFile:     write("public.pem", publicCert),
+			KeyFile:      write("public.key", publicKey),
+			UpstreamTLS: UpstreamTLSConfig{
+				Enabled:    true,
+				ServerName: "internal.local",
+				CAFile:     write("backend.pem", backendCert),
+				CertFile:   write("client.pem", clientCert),
+				KeyFile:    write("client.key", clientKey),
+			},
+		},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.handleConnection(conn.(*net.TCPConn))
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(publicCert)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "public.example.com", RootCAs: roots})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+	assert.Equal(t, <-sni, "internal.local")
+}
+
+func TestUpstreamTLSProxyProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcprouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+
+	publicCert, publicKey := selfSignedCert(t, "public.example.com")
+	backendCert, backendKey := selfSignedCert(t, "internal.local")
+	backendPair, err := tls.X509KeyPair(backendCert, backendKey)
+	require.NoError(t, err)
+
+	// the backend reads the PROXY protocol header before starting the TLS handshake
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var hdr []byte
+		b := make([]byte, 1)
+		for !strings.HasSuffix(string(hdr), "\r\n") {
+			if _, err := conn.Read(b); err != nil {
+				return
+			}
+			hdr = append(hdr, b[0])
+		}
+		headers <- string(hdr)
+
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{backendPair}})
+		line, _ := bufio.NewReader(tlsConn).ReadString('\n')
+		tlsConn.Write([]byte(line))
+	}()
+
+	s := NewServer(ServerOptions{}, nil, map[string]Service{
+		"public.example.com": {
+			Addr:          "127.0.0.1",
+			TLSPort:       backend.Addr().(*net.TCPAddr).Port,
+			TerminateTLS:  true,
+			CertFile:      write("public.pem", publicCert),
+			KeyFile:       write("public.key", publicKey),
+			ProxyProtocol: 1,
+			UpstreamTLS: UpstreamTLSConfig{
+				Enabled:    true,
+				ServerName: "internal.local",
+				CAFile:     write("backend.pem", backendCert),
+			},
+		},
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.handleConnection(conn.(*net.TCPConn))
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(publicCert)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "public.example.com", RootCAs: roots})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, line, "hello\n")
+
+	hdr, err := parseProxyHeader([]byte(<-headers))
+	require.NoError(t, err)
+	assert.Equal(t, hdr.Source.String(), conn.LocalAddr().String())
+}